@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"gps-no-sync/internal/config"
+	"gps-no-sync/internal/database/postgres"
+	"gps-no-sync/internal/database/postgres/repositories"
+	"gps-no-sync/internal/interfaces"
+	"gps-no-sync/internal/logger"
+	"gps-no-sync/internal/models"
+	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/mq/schemas"
+	"gps-no-sync/internal/services"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCommand executes one of the maintenance commands that can be passed as
+// first argument instead of starting the service.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "dlq-replay":
+		return runDeadLetterReplay(args)
+	case "schema":
+		return runSchema(args)
+	case "command":
+		return runStationCommand(args)
+	case "station":
+		return runStationProvisioning(args)
+	default:
+		return fmt.Errorf("unknown command %q, available commands: dlq-replay, schema, command, station", name)
+	}
+}
+
+func runDeadLetterReplay(args []string) error {
+	flags := flag.NewFlagSet("dlq-replay", flag.ContinueOnError)
+	family := flags.String("family", "", "only replay dead letters of this topic family (stations, clusters, measurements)")
+	timeout := flags.Duration("timeout", time.Minute, "maximum duration of the replay")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	configWrapper := config.NewWrapper()
+	logger.NewLogger(&configWrapper.LoggerConfig)
+
+	err := config.ValidateComponents(map[string]interfaces.Config{
+		"MQTT":    &configWrapper.MQTTConfig,
+		"service": &configWrapper.ServiceConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The running service owns the outbox file and the status topic, so the
+	// command publishes directly and does not announce itself.
+	mqttConfig := configWrapper.MQTTConfig
+	mqttConfig.OutboxEnabled = false
+	mqttConfig.PresenceEnabled = false
+
+	client, err := mq.NewClient(&mqttConfig, &configWrapper.ServiceConfig, logger.GetLogger("mqtt-client"))
+	if err != nil {
+		return fmt.Errorf("could not create MQTT client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		return fmt.Errorf("could not connect to MQTT broker: %w", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	topicManager := mq.NewTopicManager(mqttConfig.BaseTopic, logger.GetLogger("topic-manager"))
+	deadLetters := mq.NewDeadLetterQueue(client, topicManager, logger.GetLogger("dead-letter-queue"))
+
+	replayed, err := deadLetters.Replay(ctx, *family)
+	if err != nil {
+		return fmt.Errorf("replayed %d dead letters before failing: %w", replayed, err)
+	}
+
+	log.Info().Int("replayed", replayed).Msg("Dead letter replay finished")
+	return nil
+}
+
+// runSchema prints the payload schema of one topic family, or all schemas keyed
+// by family when no family is given. "schema proto" prints the Protobuf
+// definition of binary measurement payloads.
+func runSchema(args []string) error {
+	if len(args) > 0 && args[0] == "proto" {
+		document, err := schemas.Proto()
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(document)
+		return err
+	}
+
+	if len(args) > 0 {
+		document, err := schemas.Schema(args[0])
+		if err != nil {
+			return fmt.Errorf("%w, available families: %s", err, strings.Join(schemas.Families(), ", "))
+		}
+		_, err = os.Stdout.Write(document)
+		return err
+	}
+
+	documents := make(map[string]json.RawMessage)
+	for _, family := range schemas.Families() {
+		document, err := schemas.Schema(family)
+		if err != nil {
+			return err
+		}
+		documents[family] = document
+	}
+
+	return printJson(documents)
+}
+
+// runStationCommand issues and inspects station commands. They are stored in
+// Postgres and sent by the leading sync instance.
+func runStationCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, available subcommands: send, status, list")
+	}
+
+	configWrapper := config.NewWrapper()
+	logger.NewLogger(&configWrapper.LoggerConfig)
+
+	err := config.ValidateComponents(map[string]interfaces.Config{
+		"Postgres": &configWrapper.PostgresConfig,
+		"command":  &configWrapper.CommandConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	postgresDB, err := postgres.NewConnection(&configWrapper.PostgresConfig)
+	if err != nil {
+		return fmt.Errorf("could not connect to PostgreSQL: %w", err)
+	}
+	defer postgresDB.Close()
+
+	db := postgresDB.GetDB()
+	commandService := services.NewCommandService(
+		repositories.NewCommandRepository(db),
+		repositories.NewStationRepository(db),
+		nil,
+		nil,
+		&configWrapper.CommandConfig,
+		logger.GetLogger("command-service"),
+	)
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "send":
+		flags := flag.NewFlagSet("command send", flag.ContinueOnError)
+		station := flags.String("station", "", "topic id of the station")
+		name := flags.String("name", "", "command to send")
+		params := flags.String("params", "", "command parameters as JSON object, e.g. {\"mode\":\"TAG\"}")
+		wait := flags.Duration("wait", 0, "wait up to this long for the command to complete")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		var commandParams map[string]interface{}
+		if *params != "" {
+			if err := json.Unmarshal([]byte(*params), &commandParams); err != nil {
+				return fmt.Errorf("invalid params: %w", err)
+			}
+		}
+
+		command, err := commandService.Issue(ctx, *station, models.CommandName(*name), commandParams)
+		if err != nil {
+			return err
+		}
+
+		if *wait > 0 {
+			waitCtx, cancel := context.WithTimeout(ctx, *wait)
+			defer cancel()
+
+			command, err = commandService.Wait(waitCtx, command.CommandID)
+			if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+		}
+		return printJson(command)
+	case "status":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: command status <id>")
+		}
+
+		command, err := commandService.Get(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return printJson(command)
+	case "list":
+		flags := flag.NewFlagSet("command list", flag.ContinueOnError)
+		station := flags.String("station", "", "only list commands of this station")
+		limit := flags.Int("limit", 20, "maximum number of commands")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		commands, err := commandService.List(ctx, *station, *limit)
+		if err != nil {
+			return err
+		}
+		return printJson(commands)
+	default:
+		return fmt.Errorf("unknown subcommand %q, available subcommands: send, status, list", args[0])
+	}
+}
+
+// runStationProvisioning lists stations awaiting approval and approves or
+// rejects them. The leading sync instance publishes approved stations.
+func runStationProvisioning(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, available subcommands: pending, approve, reject")
+	}
+
+	configWrapper := config.NewWrapper()
+	logger.NewLogger(&configWrapper.LoggerConfig)
+
+	err := config.ValidateComponents(map[string]interfaces.Config{
+		"Postgres": &configWrapper.PostgresConfig,
+		"service":  &configWrapper.ServiceConfig,
+	})
+	if err != nil {
+		return err
+	}
+
+	postgresDB, err := postgres.NewConnection(&configWrapper.PostgresConfig)
+	if err != nil {
+		return fmt.Errorf("could not connect to PostgreSQL: %w", err)
+	}
+	defer postgresDB.Close()
+
+	db := postgresDB.GetDB()
+	stationService := services.NewStationService(
+		repositories.NewStationRepository(db),
+		nil,
+		repositories.NewClusterRepository(db),
+		nil,
+		nil,
+		logger.GetLogger("station-service"),
+		configWrapper.ServiceConfig.StationConflictPolicy,
+		nil,
+	)
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "pending":
+		stations, err := stationService.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		return printJson(stations)
+	case "approve", "reject":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: station %s <mac address>", args[0])
+		}
+
+		change := stationService.Approve
+		if args[0] == "reject" {
+			change = stationService.Reject
+		}
+
+		station, err := change(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		return printJson(station)
+	default:
+		return fmt.Errorf("unknown subcommand %q, available subcommands: pending, approve, reject", args[0])
+	}
+}
+
+func printJson(value interface{}) error {
+	output, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(output))
+	return err
+}
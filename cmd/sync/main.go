@@ -3,15 +3,18 @@ package main
 import (
 	"context"
 	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog/log"
 	"gps-no-sync/internal/config"
 	"gps-no-sync/internal/database/influxdb"
 	"gps-no-sync/internal/database/postgres"
+	"gps-no-sync/internal/database/postgres/election"
 	"gps-no-sync/internal/database/postgres/listeners"
 	"gps-no-sync/internal/database/postgres/repositories"
 	"gps-no-sync/internal/interfaces"
 	"gps-no-sync/internal/logger"
 	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/mq/codec"
 	"gps-no-sync/internal/mq/handlers"
 	"gps-no-sync/internal/services"
 	"os"
@@ -26,19 +29,28 @@ type ApplicationImpl struct {
 	postgresDB      *postgres.PostgresDB
 	influxDB        *influxdb.InfluxDB
 	listenerManager interfaces.IListenerManager
+	leaderElector   *election.LeaderElector
 
 	stationRepository *repositories.StationRepository
 	clusterRepository *repositories.ClusterRepository
+	commandRepository *repositories.CommandRepository
 
 	stationService     *services.StationService
 	clusterService     *services.ClusterService
 	measurementService *services.MeasurementService
+	commandService     *services.CommandService
+	livenessService    *services.LivenessService
 
 	mqttClient         *mq.Client
 	topicManager       *mq.TopicManager
+	dispatcher         *mq.Dispatcher
+	pipeline           *mq.Pipeline
+	deadLetters        *mq.DeadLetterQueue
 	stationHandler     *handlers.StationHandler
 	clusterHandler     *handlers.ClusterHandler
 	measurementHandler *handlers.MeasurementHandler
+	commandAckHandler  *handlers.CommandAckHandler
+	heartbeatHandler   *handlers.HeartbeatHandler
 
 	shutdownChan chan os.Signal
 	ctx          context.Context
@@ -46,13 +58,26 @@ type ApplicationImpl struct {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Str("command", os.Args[1]).Msg("Command failed")
+		}
+		return
+	}
+
 	app := &ApplicationImpl{}
 
 	if err := app.initialize(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize application")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := app.run(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to run application")
+	}
+}
+
+func (app *ApplicationImpl) resync() {
+	ctx, cancel := context.WithTimeout(app.ctx, 10*time.Second)
 	defer cancel()
 
 	err := app.stationService.SyncAll(ctx)
@@ -64,10 +89,6 @@ func main() {
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to sync all clusters to MQTTConfig")
 	}
-
-	if err := app.run(); err != nil {
-		log.Fatal().Err(err).Msg("Failed to run application")
-	}
 }
 
 func (app *ApplicationImpl) initialize() error {
@@ -76,9 +97,13 @@ func (app *ApplicationImpl) initialize() error {
 	logger.NewLogger(&app.configWrapper.LoggerConfig)
 	log.Info().
 		Str("component", "main").
-		Str("version", "1.0.0").
+		Str("version", app.configWrapper.ServiceConfig.Version).
 		Msg("Setting up service...")
 
+	if err := app.configWrapper.Validate(); err != nil {
+		return err
+	}
+
 	app.ctx, app.cancelFunc = context.WithCancel(context.Background())
 	app.shutdownChan = make(chan os.Signal, 1)
 	signal.Notify(app.shutdownChan, syscall.SIGINT, syscall.SIGTERM)
@@ -106,6 +131,11 @@ func (app *ApplicationImpl) initialize() error {
 	if err := app.setupTableListeners(); err != nil {
 		return fmt.Errorf("error while setting up table listeners: %w", err)
 	}
+
+	app.startLeaderElection()
+	go app.commandService.Run(app.ctx, app.leaderElector.IsLeader)
+	go app.livenessService.Run(app.ctx, app.leaderElector.IsLeader)
+
 	log.Info().Msg("Successfully initialized application")
 	return nil
 }
@@ -123,44 +153,174 @@ func (app *ApplicationImpl) initializeDatabases() error {
 		return fmt.Errorf("could not connect to InfluxConfig: %w", err)
 	}
 
+	app.leaderElector = election.NewLeaderElector(
+		app.postgresDB.GetDB(),
+		&app.configWrapper.LeaderConfig,
+		logger.GetLogger("leader-elector"),
+	)
+
 	return nil
 }
 
+// startLeaderElection lets only the leader publish database state to MQTT,
+// while measurements are ingested by every replica.
+func (app *ApplicationImpl) startLeaderElection() {
+	app.leaderElector.OnLeadershipChange(func(isLeader bool) {
+		if err := app.mqttClient.SetLeader(isLeader); err != nil {
+			log.Error().Err(err).Msg("Failed to publish leadership change")
+		}
+
+		if isLeader {
+			log.Info().Msg("Became leader, syncing stations and clusters")
+			go app.resync()
+		}
+	})
+
+	app.leaderElector.Start()
+}
+
+func (app *ApplicationImpl) leaderOnly(next mq.HandlerFunc) mq.HandlerFunc {
+	return func(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+		if !app.leaderElector.IsLeader() {
+			return
+		}
+		next(ctx, client, msg)
+	}
+}
+
+// newPipeline returns the middleware chain every topic handler is registered
+// through. Additional middleware can be added with Use before the handlers are
+// set up.
+func (app *ApplicationImpl) newPipeline() *mq.Pipeline {
+	serviceConfig := app.configWrapper.ServiceConfig
+	pipelineLogger := logger.GetLogger("handler-pipeline")
+	reject := handlers.Rejecter(app.deadLetters, pipelineLogger)
+
+	return mq.NewPipeline(
+		mq.Recover(pipelineLogger, reject),
+		mq.Logging(pipelineLogger),
+		mq.Timing(pipelineLogger, serviceConfig.SlowHandlerThreshold),
+		mq.PayloadLimit(serviceConfig.MaxPayloadSize, reject),
+		mq.Deadline(serviceConfig.HandlerTimeout),
+	)
+}
+
 func (app *ApplicationImpl) setupTopicHandlers() error {
+	payloadValidator, err := handlers.NewPayloadValidator(
+		app.mqttClient,
+		app.topicManager,
+		logger.GetLogger("payload-validator"),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating payload validator: %w", err)
+	}
+	repairLimiter := handlers.NewRepairLimiter(app.configWrapper.ServiceConfig.RepairInterval)
+	replier := handlers.NewReplier(app.mqttClient, logger.GetLogger("replier"))
+
 	app.stationHandler = handlers.NewStationHandler(
 		app.stationService,
 		logger.GetLogger("station-handler"),
 		app.topicManager,
+		payloadValidator,
+		app.deadLetters,
+		repairLimiter,
+		replier,
 	)
 
 	app.clusterHandler = handlers.NewClusterHandler(
 		app.clusterService,
 		logger.GetLogger("cluster-handler"),
 		app.topicManager,
+		payloadValidator,
+		app.deadLetters,
+		repairLimiter,
+		replier,
 	)
 
+	decoders := codec.NewRegistry()
 	app.measurementHandler = handlers.NewMeasurementHandler(
 		app.measurementService,
 		logger.GetLogger("measurement-handler"),
 		app.topicManager,
+		payloadValidator,
+		app.deadLetters,
+		decoders,
 	)
 
 	qos := app.configWrapper.MQTTConfig.QoS
 	stationTopic := app.topicManager.GetStationTopic()
-	if err := app.mqttClient.Subscribe(stationTopic, qos, app.stationHandler.HandleMessage); err != nil {
+	stationHandler := app.dispatcher.Handle(stationTopic, app.pipeline.Then(app.stationHandler.HandleMessage, app.leaderOnly))
+	if err := app.mqttClient.Subscribe(stationTopic, qos, stationHandler); err != nil {
 		return fmt.Errorf("error subscribing to station Topic: %w", err)
 	}
 
+	stationPatchTopic := app.topicManager.GetStationPatchTopic()
+	stationPatchHandler := app.dispatcher.Handle(stationPatchTopic, app.pipeline.Then(app.stationHandler.HandlePatch, app.leaderOnly))
+	if err := app.mqttClient.Subscribe(stationPatchTopic, qos, stationPatchHandler); err != nil {
+		return fmt.Errorf("error subscribing to station patch Topic: %w", err)
+	}
+
 	clusterTopic := app.topicManager.GetClusterTopic()
-	if err := app.mqttClient.Subscribe(clusterTopic, qos, app.clusterHandler.HandleMessage); err != nil {
+	clusterHandler := app.dispatcher.Handle(clusterTopic, app.pipeline.Then(app.clusterHandler.HandleMessage, app.leaderOnly))
+	if err := app.mqttClient.Subscribe(clusterTopic, qos, clusterHandler); err != nil {
 		return fmt.Errorf("error subscribing to cluster Topic: %w", err)
 	}
 
-	measurementTopic := app.topicManager.GetMeasurementTopic()
-	if err := app.mqttClient.Subscribe(measurementTopic, qos, app.measurementHandler.HandleMessage); err != nil {
+	if app.configWrapper.ServiceConfig.ClusterRequestsEnabled {
+		clusterRequestTopic := app.topicManager.GetClusterRequestTopic()
+		clusterRequestHandler := app.dispatcher.Handle(clusterRequestTopic, app.pipeline.Then(app.clusterHandler.HandleRequest, app.leaderOnly))
+		if err := app.mqttClient.Subscribe(clusterRequestTopic, qos, clusterRequestHandler); err != nil {
+			return fmt.Errorf("error subscribing to cluster request Topic: %w", err)
+		}
+	}
+
+	shareGroup := app.configWrapper.MQTTConfig.MeasurementShareGroup
+	measurementTopic := app.topicManager.GetMeasurementSubscription(shareGroup)
+	measurementHandler := app.dispatcher.Handle(measurementTopic, app.pipeline.Then(app.measurementHandler.HandleMessage))
+	if err := app.mqttClient.Subscribe(measurementTopic, qos, measurementHandler); err != nil {
 		return fmt.Errorf("error subscribing to measurement Topic: %w", err)
 	}
 
+	for _, encoding := range decoders.Encodings() {
+		encodingTopic := app.topicManager.GetMeasurementEncodingSubscription(shareGroup, encoding)
+		if err := app.mqttClient.Subscribe(encodingTopic, qos, measurementHandler); err != nil {
+			return fmt.Errorf("error subscribing to %s measurement Topic: %w", encoding, err)
+		}
+	}
+
+	app.heartbeatHandler = handlers.NewHeartbeatHandler(app.livenessService, logger.GetLogger("heartbeat-handler"))
+
+	heartbeatTopic := app.topicManager.GetHeartbeatSubscription(shareGroup)
+	heartbeatHandler := app.dispatcher.Handle(heartbeatTopic, app.pipeline.Then(app.heartbeatHandler.HandleMessage))
+	if err := app.mqttClient.Subscribe(heartbeatTopic, qos, heartbeatHandler); err != nil {
+		return fmt.Errorf("error subscribing to heartbeat Topic: %w", err)
+	}
+
+	app.commandAckHandler = handlers.NewCommandAckHandler(
+		app.commandService,
+		logger.GetLogger("command-ack-handler"),
+		app.topicManager,
+		app.deadLetters,
+	)
+
+	commandAckTopic := app.topicManager.GetCommandAckTopic()
+	commandAckHandler := app.dispatcher.Handle(commandAckTopic, app.pipeline.Then(app.commandAckHandler.HandleMessage, app.leaderOnly))
+	if err := app.mqttClient.Subscribe(commandAckTopic, qos, commandAckHandler); err != nil {
+		return fmt.Errorf("error subscribing to command ack Topic: %w", err)
+	}
+
+	app.mqttClient.OnReconnect(func() {
+		if !app.leaderElector.IsLeader() {
+			return
+		}
+		log.Info().Msg("Reconnected to MQTT broker, resyncing stations and clusters")
+		app.resync()
+	})
+
+	if err := app.mqttClient.AnnouncePresence(); err != nil {
+		log.Error().Err(err).Msg("Failed to announce service presence")
+	}
+
 	return nil
 }
 
@@ -170,6 +330,7 @@ func (app *ApplicationImpl) setupTableListeners() error {
 	app.listenerManager = listeners.NewListenerManager(
 		app.postgresDB.GetDB(),
 		dsn,
+		app.leaderElector.IsLeader,
 		logger.GetLogger("listener-manager"),
 	)
 
@@ -209,6 +370,7 @@ func (app *ApplicationImpl) initializeRepositories() error {
 
 	app.stationRepository = repositories.NewStationRepository(db)
 	app.clusterRepository = repositories.NewClusterRepository(db)
+	app.commandRepository = repositories.NewCommandRepository(db)
 
 	log.Info().
 		Str("component", "main").
@@ -222,8 +384,10 @@ func (app *ApplicationImpl) initializeServices() error {
 		app.mqttClient,
 		app.topicManager,
 		logger.GetLogger("cluster-service"),
+		app.configWrapper.ServiceConfig.ClusterCreationPolicy,
 	)
 
+	serviceConfig := app.configWrapper.ServiceConfig
 	app.stationService = services.NewStationService(
 		app.stationRepository,
 		app.clusterService,
@@ -231,12 +395,51 @@ func (app *ApplicationImpl) initializeServices() error {
 		app.mqttClient,
 		app.topicManager,
 		logger.GetLogger("station-service"),
+		serviceConfig.StationConflictPolicy,
+		services.NewProvisioningPolicy(serviceConfig.ProvisioningPolicy, serviceConfig.ProvisioningAllowlist),
+	)
+
+	app.livenessService = services.NewLivenessService(
+		app.stationRepository,
+		app.influxDB,
+		app.mqttClient,
+		app.topicManager,
+		app.configWrapper.ServiceConfig.DeviceUpdateInterval,
+		app.configWrapper.ServiceConfig.DeviceTimeoutDuration,
+		logger.GetLogger("liveness-service"),
 	)
 
+	var deduplicator *services.MeasurementDeduplicator
+	if serviceConfig := app.configWrapper.ServiceConfig; serviceConfig.DedupEnabled {
+		deduplicator = services.NewMeasurementDeduplicator(serviceConfig.DedupWindow, serviceConfig.DedupMaxEntries)
+	}
+
+	var clocks *services.ClockEstimator
+	if serviceConfig := app.configWrapper.ServiceConfig; serviceConfig.ClockCorrectionEnabled {
+		clocks = services.NewClockEstimator(
+			serviceConfig.ClockSampleWindow,
+			serviceConfig.ClockReportInterval,
+			serviceConfig.ClockSkewThreshold,
+		)
+	}
+
 	app.measurementService = services.NewMeasurementService(
 		app.influxDB,
+		app.mqttClient,
 		app.topicManager,
 		logger.GetLogger("measurement-service"),
+		deduplicator,
+		clocks,
+		app.livenessService,
+	)
+
+	app.commandService = services.NewCommandService(
+		app.commandRepository,
+		app.stationRepository,
+		app.mqttClient,
+		app.topicManager,
+		&app.configWrapper.CommandConfig,
+		logger.GetLogger("command-service"),
 	)
 
 	log.Info().
@@ -250,12 +453,25 @@ func (app *ApplicationImpl) initializeMQTT() error {
 
 	baseTopic := app.configWrapper.MQTTConfig.BaseTopic
 	app.topicManager = mq.NewTopicManager(baseTopic, logger.GetLogger("topic-manager"))
+	app.dispatcher = mq.NewDispatcher(&app.configWrapper.ServiceConfig, logger.GetLogger("dispatcher"))
 
-	app.mqttClient, err = mq.NewClient(&app.configWrapper.MQTTConfig, logger.GetLogger("mqtt-client"))
+	app.mqttClient, err = mq.NewClient(
+		&app.configWrapper.MQTTConfig,
+		&app.configWrapper.ServiceConfig,
+		logger.GetLogger("mqtt-client"),
+	)
 	if err != nil {
 		return fmt.Errorf("could not create MQTT client: %w", err)
 	}
 
+	app.deadLetters = mq.NewDeadLetterQueue(app.mqttClient, app.topicManager, logger.GetLogger("dead-letter-queue"))
+	app.dispatcher.SetDeadLetterSink(func(family string, msg mqtt.Message, reason error) {
+		if err := app.deadLetters.Publish(msg, "ErrQueueFull", reason); err != nil {
+			log.Error().Err(err).Str("family", family).Msg("Failed to dead-letter overflowing message")
+		}
+	})
+	app.pipeline = app.newPipeline()
+
 	connectCtx, cancel := context.WithTimeout(app.ctx, 30*time.Second)
 	defer cancel()
 
@@ -286,7 +502,32 @@ func (app *ApplicationImpl) shutdown() error {
 		app.listenerManager.Stop()
 	}
 
+	if app.leaderElector != nil {
+		app.leaderElector.Stop()
+	}
+
+	if app.dispatcher != nil {
+		stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := app.dispatcher.Stop(stopCtx); err != nil {
+			log.Error().Err(err).Msg("Failed to drain message queues")
+		}
+		cancel()
+	}
+
+	if app.measurementService != nil {
+		stats := app.measurementService.DedupStats()
+		log.Info().
+			Uint64("duplicates", stats.Duplicates).
+			Uint64("evictions", stats.Evictions).
+			Msg("Measurement de-duplication statistics")
+	}
+
 	if app.mqttClient != nil {
+		if app.mqttClient.IsConnected() {
+			if err := app.mqttClient.PublishOffline(); err != nil {
+				log.Error().Err(err).Msg("Failed to publish offline service status")
+			}
+		}
 		app.mqttClient.Disconnect(app.ctx)
 	}
 
@@ -0,0 +1,74 @@
+package components
+
+import (
+	"fmt"
+	"gps-no-sync/internal/config/shared"
+	"gps-no-sync/internal/interfaces"
+	"time"
+)
+
+type CommandConfig interface {
+	interfaces.Config
+}
+
+// CommandConfigImpl is the retry policy of station commands. A command is
+// resent when no ack arrived within AckTimeout, waiting RetryBackoff before
+// the first retry and twice as long before every further one, until
+// MaxAttempts sends were made.
+type CommandConfigImpl struct {
+	AckTimeout   time.Duration `json:"ack_timeout"`
+	MaxAttempts  int           `json:"max_attempts"`
+	RetryBackoff time.Duration `json:"retry_backoff"`
+	PollInterval time.Duration `json:"poll_interval"`
+}
+
+func NewCommandConfig() CommandConfigImpl {
+	config := CommandConfigImpl{}
+	config.Load()
+	config.SetDefaults()
+	return config
+}
+
+func (C *CommandConfigImpl) Load() {
+	C.AckTimeout = shared.GetEnvAsDuration("COMMAND_ACK_TIMEOUT")
+	C.MaxAttempts = shared.GetEnvAsInt("COMMAND_MAX_ATTEMPTS")
+	C.RetryBackoff = shared.GetEnvAsDuration("COMMAND_RETRY_BACKOFF")
+	C.PollInterval = shared.GetEnvAsDuration("COMMAND_POLL_INTERVAL")
+}
+
+func (C *CommandConfigImpl) SetDefaults() {
+	if C.AckTimeout <= 0 {
+		C.AckTimeout = 10 * time.Second
+	}
+	if C.MaxAttempts <= 0 {
+		C.MaxAttempts = 3
+	}
+	if C.RetryBackoff <= 0 {
+		C.RetryBackoff = 5 * time.Second
+	}
+	if C.PollInterval <= 0 {
+		C.PollInterval = time.Second
+	}
+}
+
+func (C *CommandConfigImpl) Validate() error {
+	if C.AckTimeout <= 0 {
+		return fmt.Errorf("COMMAND_ACK_TIMEOUT must be greater than 0")
+	}
+
+	if C.MaxAttempts <= 0 {
+		return fmt.Errorf("COMMAND_MAX_ATTEMPTS must be greater than 0")
+	}
+
+	if C.RetryBackoff <= 0 {
+		return fmt.Errorf("COMMAND_RETRY_BACKOFF must be greater than 0")
+	}
+
+	if C.PollInterval <= 0 {
+		return fmt.Errorf("COMMAND_POLL_INTERVAL must be greater than 0")
+	}
+
+	return nil
+}
+
+var _ CommandConfig = (*CommandConfigImpl)(nil)
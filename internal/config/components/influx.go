@@ -71,7 +71,7 @@ func (I *InfluxConfigImpl) Validate() error {
 	if I.Bucket == "" {
 		return fmt.Errorf("influxdb bucket is required")
 	}
-	if !(I.URL[:7] == "http://" || I.URL[:8] == "https://") {
+	if !strings.HasPrefix(I.URL, "http://") && !strings.HasPrefix(I.URL, "https://") {
 		return fmt.Errorf("influxdb url must start with http:// or https://")
 	}
 	if I.BatchSize <= 0 {
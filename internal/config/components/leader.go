@@ -0,0 +1,50 @@
+package components
+
+import (
+	"fmt"
+	"gps-no-sync/internal/config/shared"
+	"gps-no-sync/internal/interfaces"
+	"time"
+)
+
+type LeaderConfig interface {
+	interfaces.Config
+}
+
+type LeaderConfigImpl struct {
+	Enabled       bool          `json:"enabled"`
+	LockKey       int64         `json:"lock_key"`
+	RetryInterval time.Duration `json:"retry_interval"`
+}
+
+func NewLeaderConfig() LeaderConfigImpl {
+	config := LeaderConfigImpl{}
+	config.Load()
+	config.SetDefaults()
+	return config
+}
+
+func (L *LeaderConfigImpl) Load() {
+	L.Enabled = shared.GetEnvAsBool("LEADER_ELECTION_ENABLED", true)
+	L.LockKey = int64(shared.GetEnvAsInt("LEADER_LOCK_KEY"))
+	L.RetryInterval = shared.GetEnvAsDuration("LEADER_RETRY_INTERVAL")
+}
+
+func (L *LeaderConfigImpl) SetDefaults() {
+	if L.LockKey == 0 {
+		L.LockKey = 7158278
+	}
+	if L.RetryInterval <= 0 {
+		L.RetryInterval = 5 * time.Second
+	}
+}
+
+func (L *LeaderConfigImpl) Validate() error {
+	if L.RetryInterval <= 0 {
+		return fmt.Errorf("LEADER_RETRY_INTERVAL must be greater than 0")
+	}
+
+	return nil
+}
+
+var _ LeaderConfig = (*LeaderConfigImpl)(nil)
@@ -5,6 +5,9 @@ import (
 	"github.com/joho/godotenv"
 	"gps-no-sync/internal/config/shared"
 	"gps-no-sync/internal/interfaces"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -14,18 +17,48 @@ type MQTTConfig interface {
 }
 
 type MQTTConfigImpl struct {
-	Host                 string        `json:"host"`
-	Port                 int           `json:"port"`
-	Url                  string        `json:"url"`
-	Username             string        `json:"username"`
-	Password             string        `json:"password"`
-	ClientID             string        `json:"client_id"`
-	BaseTopic            string        `json:"base_topic"`
-	QoS                  byte          `json:"qos"`
-	KeepAlive            time.Duration `json:"keep_alive"`
-	AutoReconnect        bool          `json:"auto_reconnect"`
-	MaxReconnectInterval time.Duration `json:"max_reconnect_interval"`
-	CleanSession         bool          `json:"clean_session"`
+	Host                  string            `json:"host"`
+	Port                  int               `json:"port"`
+	Url                   string            `json:"url"`
+	Username              string            `json:"username"`
+	Password              string            `json:"password"`
+	ClientID              string            `json:"client_id"`
+	InstanceName          string            `json:"instance_name"`
+	PresenceEnabled       bool              `json:"presence_enabled"`
+	BaseTopic             string            `json:"base_topic"`
+	QoS                   byte              `json:"qos"`
+	KeepAlive             time.Duration     `json:"keep_alive"`
+	AutoReconnect         bool              `json:"auto_reconnect"`
+	MaxReconnectInterval  time.Duration     `json:"max_reconnect_interval"`
+	CleanSession          bool              `json:"clean_session"`
+	Scheme                string            `json:"scheme"`
+	TLSEnabled            bool              `json:"tls_enabled"`
+	TLSCAFile             string            `json:"tls_ca_file"`
+	TLSCertFile           string            `json:"tls_cert_file"`
+	TLSKeyFile            string            `json:"tls_key_file"`
+	TLSServerName         string            `json:"tls_server_name"`
+	TLSInsecureSkip       bool              `json:"tls_insecure_skip_verify"`
+	OutboxEnabled         bool              `json:"outbox_enabled"`
+	OutboxPath            string            `json:"outbox_path"`
+	OutboxMaxEntries      int               `json:"outbox_max_entries"`
+	ProtocolVersion       int               `json:"protocol_version"`
+	MeasurementExpiry     time.Duration     `json:"measurement_expiry"`
+	MaxHops               int               `json:"max_hops"`
+	MeasurementShareGroup string            `json:"measurement_share_group"`
+	WebsocketPath         string            `json:"websocket_path"`
+	WebsocketHeaders      map[string]string `json:"websocket_headers"`
+}
+
+var tlsSchemes = map[string]bool{
+	"ssl":   true,
+	"tls":   true,
+	"mqtts": true,
+	"wss":   true,
+}
+
+var websocketSchemes = map[string]bool{
+	"ws":  true,
+	"wss": true,
 }
 
 func NewMQTTConfig() MQTTConfigImpl {
@@ -40,28 +73,78 @@ func (M *MQTTConfigImpl) Load() {
 
 	M.Host = shared.GetEnv("MQTT_HOST")
 	M.Port = shared.GetEnvAsInt("MQTT_PORT")
+	M.Url = shared.GetEnv("MQTT_URL")
 	M.Username = shared.GetEnv("MQTT_USERNAME")
 	M.Password = shared.GetEnv("MQTT_PASSWORD")
 	M.ClientID = shared.GetEnv("MQTT_CLIENT_ID")
+	M.InstanceName = shared.GetEnv("MQTT_INSTANCE_NAME")
+	M.PresenceEnabled = shared.GetEnvAsBool("MQTT_PRESENCE_ENABLED", true)
 	M.BaseTopic = shared.GetEnv("MQTT_BASE_TOPIC")
 	M.QoS = byte(shared.GetEnvAsInt("MQTT_QOS"))
 	M.KeepAlive = shared.GetEnvAsDuration("MQTT_KEEP_ALIVE")
 	M.AutoReconnect = shared.GetEnvAsBool("MQTT_AUTO_RECONNECT", true)
 	M.MaxReconnectInterval = shared.GetEnvAsDuration("MQTT_MAX_RECONNECT_INTERVAL")
 	M.CleanSession = shared.GetEnvAsBool("MQTT_CLEAN_SESSION", true)
+	M.Scheme = strings.ToLower(shared.GetEnv("MQTT_SCHEME"))
+	M.TLSEnabled = shared.GetEnvAsBool("MQTT_TLS_ENABLED", false)
+	M.TLSCAFile = shared.GetEnv("MQTT_TLS_CA_FILE")
+	M.TLSCertFile = shared.GetEnv("MQTT_TLS_CERT_FILE")
+	M.TLSKeyFile = shared.GetEnv("MQTT_TLS_KEY_FILE")
+	M.TLSServerName = shared.GetEnv("MQTT_TLS_SERVER_NAME")
+	M.TLSInsecureSkip = shared.GetEnvAsBool("MQTT_TLS_INSECURE_SKIP_VERIFY", false)
+	M.OutboxEnabled = shared.GetEnvAsBool("MQTT_OUTBOX_ENABLED", true)
+	M.OutboxPath = shared.GetEnv("MQTT_OUTBOX_PATH")
+	M.OutboxMaxEntries = shared.GetEnvAsInt("MQTT_OUTBOX_MAX_ENTRIES")
+	M.ProtocolVersion = shared.GetEnvAsInt("MQTT_PROTOCOL_VERSION")
+	M.MeasurementExpiry = shared.GetEnvAsDuration("MQTT_MEASUREMENT_EXPIRY")
+	M.MaxHops = shared.GetEnvAsInt("MQTT_MAX_HOPS")
+	M.MeasurementShareGroup = shared.GetEnv("MQTT_MEASUREMENT_SHARE_GROUP")
+	M.WebsocketPath = shared.GetEnv("MQTT_WS_PATH")
+	M.WebsocketHeaders = shared.GetEnvAsMap("MQTT_WS_HEADERS")
 }
 
 func (M *MQTTConfigImpl) SetDefaults() {
+	// A full broker URL takes precedence over the individual host/port settings.
+	if M.Url != "" {
+		M.applyUrl()
+	}
+
 	if M.Host == "" {
 		M.Host = "localhost"
 	}
+	if M.Scheme == "" {
+		M.Scheme = "tcp"
+		if M.TLSEnabled {
+			M.Scheme = "ssl"
+		}
+	}
+	if tlsSchemes[M.Scheme] {
+		M.TLSEnabled = true
+	}
 	if M.Port == 0 {
-		M.Port = 1883
+		M.Port = defaultPort(M.Scheme, M.TLSEnabled)
+	}
+	if M.Url == "" {
+		M.Url = fmt.Sprintf("%s://%s:%d", M.Scheme, M.Host, M.Port)
+		if websocketSchemes[M.Scheme] {
+			if M.WebsocketPath == "" {
+				M.WebsocketPath = "/mqtt"
+			}
+			M.Url += "/" + strings.TrimPrefix(M.WebsocketPath, "/")
+		}
 	}
-	M.Url = fmt.Sprintf("tcp://%s:%d", M.Host, M.Port)
 	if M.ClientID == "" {
 		M.ClientID = "gps-no-sync"
 	}
+	// The instance name keys the retained service status, so it has to stay the
+	// same across restarts of a replica.
+	if M.InstanceName == "" {
+		if hostname, err := os.Hostname(); err == nil && hostname != "" {
+			M.InstanceName = hostname
+		} else {
+			M.InstanceName = M.ClientID
+		}
+	}
 	if M.BaseTopic == "" {
 		M.BaseTopic = "gps-no"
 	}
@@ -75,6 +158,23 @@ func (M *MQTTConfigImpl) SetDefaults() {
 		M.MaxReconnectInterval = 10 * time.Second
 	}
 
+	if M.OutboxPath == "" {
+		M.OutboxPath = "data/mqtt-outbox.json"
+	}
+	if M.OutboxMaxEntries <= 0 {
+		M.OutboxMaxEntries = 10000
+	}
+
+	if M.ProtocolVersion == 0 {
+		M.ProtocolVersion = 3
+	}
+	if M.MeasurementExpiry <= 0 {
+		M.MeasurementExpiry = 5 * time.Minute
+	}
+	if M.MaxHops <= 0 {
+		M.MaxHops = 3
+	}
+
 	M.BaseTopic = strings.TrimSuffix(M.BaseTopic, "/")
 }
 
@@ -95,7 +195,83 @@ func (M *MQTTConfigImpl) Validate() error {
 		return fmt.Errorf("MQTT keep alive cannot be negative, got %d", M.KeepAlive)
 	}
 
+	if M.ProtocolVersion != 3 && M.ProtocolVersion != 5 {
+		return fmt.Errorf("MQTT protocol version must be 3 or 5, got %d", M.ProtocolVersion)
+	}
+
+	if M.Scheme != "tcp" && M.Scheme != "mqtt" && !tlsSchemes[M.Scheme] && !websocketSchemes[M.Scheme] {
+		return fmt.Errorf("MQTT scheme must be one of: tcp, mqtt, ssl, tls, mqtts, ws, wss, got %s", M.Scheme)
+	}
+
+	if parsed, err := url.Parse(M.Url); err != nil || parsed.Host == "" {
+		return fmt.Errorf("MQTT broker URL %s is not a valid URL", M.Url)
+	}
+
+	if len(M.WebsocketHeaders) > 0 && !websocketSchemes[M.Scheme] {
+		return fmt.Errorf("MQTT_WS_HEADERS requires a ws or wss broker URL, got scheme %s", M.Scheme)
+	}
+
+	if M.TLSEnabled && !tlsSchemes[M.Scheme] {
+		return fmt.Errorf("MQTT TLS is enabled but scheme %s is not a TLS scheme", M.Scheme)
+	}
+
+	if (M.TLSCertFile == "") != (M.TLSKeyFile == "") {
+		return fmt.Errorf("MQTT_TLS_CERT_FILE and MQTT_TLS_KEY_FILE must be set together")
+	}
+
+	if strings.ContainsAny(M.MeasurementShareGroup, "/+#") {
+		return fmt.Errorf("MQTT_MEASUREMENT_SHARE_GROUP must not contain '/', '+' or '#', got %s", M.MeasurementShareGroup)
+	}
+
+	if M.InstanceName == "" || strings.ContainsAny(M.InstanceName, "/+#") {
+		return fmt.Errorf("MQTT_INSTANCE_NAME must be set and must not contain '/', '+' or '#', got %s", M.InstanceName)
+	}
+
+	if M.OutboxEnabled && M.OutboxPath == "" {
+		return fmt.Errorf("MQTT_OUTBOX_PATH is required when the outbox is enabled")
+	}
+
+	for _, file := range []string{M.TLSCAFile, M.TLSCertFile, M.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("MQTT TLS file %s is not readable: %w", file, err)
+		}
+	}
+
 	return nil
 }
 
+// applyUrl derives scheme, host and port from a full broker URL such as
+// wss://example.org/mqtt.
+func (M *MQTTConfigImpl) applyUrl() {
+	parsed, err := url.Parse(M.Url)
+	if err != nil || parsed.Host == "" {
+		return
+	}
+
+	M.Scheme = strings.ToLower(parsed.Scheme)
+	M.Host = parsed.Hostname()
+	if port, err := strconv.Atoi(parsed.Port()); err == nil {
+		M.Port = port
+	}
+	if websocketSchemes[M.Scheme] {
+		M.WebsocketPath = parsed.Path
+	}
+}
+
+func defaultPort(scheme string, tlsEnabled bool) int {
+	switch {
+	case scheme == "ws":
+		return 80
+	case scheme == "wss":
+		return 443
+	case tlsEnabled:
+		return 8883
+	default:
+		return 1883
+	}
+}
+
 var _ MQTTConfig = (*MQTTConfigImpl)(nil)
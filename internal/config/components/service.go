@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"gps-no-sync/internal/config/shared"
 	"gps-no-sync/internal/interfaces"
+	"strings"
 	"time"
 )
 
@@ -17,10 +18,55 @@ type ServiceConfigImpl struct {
 	DeviceUpdateInterval    time.Duration `json:"device_update_interval"`
 	DeviceTimeoutDuration   time.Duration `json:"device_timeout_duration"`
 	MaxConcurrentProcessing int           `json:"max_concurrent_processing"`
+	ProcessingQueueDepth    int           `json:"processing_queue_depth"`
+	ProcessingOverflow      string        `json:"processing_overflow"`
+	RepairInterval          time.Duration `json:"repair_interval"`
+	DedupEnabled            bool          `json:"dedup_enabled"`
+	DedupWindow             time.Duration `json:"dedup_window"`
+	DedupMaxEntries         int           `json:"dedup_max_entries"`
+	ClockCorrectionEnabled  bool          `json:"clock_correction_enabled"`
+	ClockSampleWindow       int           `json:"clock_sample_window"`
+	ClockSkewThreshold      time.Duration `json:"clock_skew_threshold"`
+	ClockReportInterval     time.Duration `json:"clock_report_interval"`
+	HandlerTimeout          time.Duration `json:"handler_timeout"`
+	SlowHandlerThreshold    time.Duration `json:"slow_handler_threshold"`
+	MaxPayloadSize          int           `json:"max_payload_size"`
+	StationConflictPolicy   string        `json:"station_conflict_policy"`
+	ProvisioningPolicy      string        `json:"provisioning_policy"`
+	ProvisioningAllowlist   []string      `json:"provisioning_allowlist"`
+	ClusterRequestsEnabled  bool          `json:"cluster_requests_enabled"`
+	ClusterCreationPolicy   string        `json:"cluster_creation_policy"`
+}
+
+var overflowPolicies = map[string]bool{
+	"block":       true,
+	"drop-oldest": true,
+	"dead-letter": true,
+}
+
+var conflictPolicies = map[string]bool{
+	"db-wins":          true,
+	"device-wins":      true,
+	"last-writer-wins": true,
+}
+
+var provisioningPolicies = map[string]bool{
+	"open":      true,
+	"allowlist": true,
+	"manual":    true,
+}
+
+var clusterCreationPolicies = map[string]bool{
+	"disabled":   true,
+	"authorized": true,
+	"open":       true,
 }
 
 func NewServiceConfig() ServiceConfigImpl {
-	return ServiceConfigImpl{}
+	config := ServiceConfigImpl{}
+	config.Load()
+	config.SetDefaults()
+	return config
 }
 
 func (S *ServiceConfigImpl) Load() {
@@ -29,6 +75,24 @@ func (S *ServiceConfigImpl) Load() {
 	S.DeviceUpdateInterval = shared.GetEnvAsDuration("DEVICE_UPDATE_INTERVAL")
 	S.DeviceTimeoutDuration = shared.GetEnvAsDuration("DEVICE_TIMEOUT_DURATION")
 	S.MaxConcurrentProcessing = shared.GetEnvAsInt("MAX_CONCURRENT_PROCESSING")
+	S.ProcessingQueueDepth = shared.GetEnvAsInt("PROCESSING_QUEUE_DEPTH")
+	S.ProcessingOverflow = strings.ToLower(shared.GetEnv("PROCESSING_OVERFLOW_POLICY"))
+	S.RepairInterval = shared.GetEnvAsDuration("REPAIR_MIN_INTERVAL")
+	S.DedupEnabled = shared.GetEnvAsBool("MEASUREMENT_DEDUP_ENABLED", true)
+	S.DedupWindow = shared.GetEnvAsDuration("MEASUREMENT_DEDUP_WINDOW")
+	S.DedupMaxEntries = shared.GetEnvAsInt("MEASUREMENT_DEDUP_MAX_ENTRIES")
+	S.ClockCorrectionEnabled = shared.GetEnvAsBool("CLOCK_CORRECTION_ENABLED", true)
+	S.ClockSampleWindow = shared.GetEnvAsInt("CLOCK_SAMPLE_WINDOW")
+	S.ClockSkewThreshold = shared.GetEnvAsDuration("CLOCK_SKEW_WARN_THRESHOLD")
+	S.ClockReportInterval = shared.GetEnvAsDuration("CLOCK_REPORT_INTERVAL")
+	S.HandlerTimeout = shared.GetEnvAsDuration("HANDLER_TIMEOUT")
+	S.SlowHandlerThreshold = shared.GetEnvAsDuration("SLOW_HANDLER_THRESHOLD")
+	S.MaxPayloadSize = shared.GetEnvAsInt("MAX_PAYLOAD_SIZE")
+	S.StationConflictPolicy = strings.ToLower(shared.GetEnv("STATION_CONFLICT_POLICY"))
+	S.ProvisioningPolicy = strings.ToLower(shared.GetEnv("STATION_PROVISIONING_POLICY"))
+	S.ProvisioningAllowlist = shared.GetEnvAsList("STATION_PROVISIONING_ALLOWLIST")
+	S.ClusterRequestsEnabled = shared.GetEnvAsBool("CLUSTER_REQUESTS_ENABLED", false)
+	S.ClusterCreationPolicy = strings.ToLower(shared.GetEnv("CLUSTER_CREATION_POLICY"))
 }
 
 func (S *ServiceConfigImpl) SetDefaults() {
@@ -47,7 +111,48 @@ func (S *ServiceConfigImpl) SetDefaults() {
 	if S.MaxConcurrentProcessing <= 0 {
 		S.MaxConcurrentProcessing = 10
 	}
-
+	if S.ProcessingQueueDepth <= 0 {
+		S.ProcessingQueueDepth = 100
+	}
+	if S.ProcessingOverflow == "" {
+		S.ProcessingOverflow = "block"
+	}
+	if S.RepairInterval <= 0 {
+		S.RepairInterval = 30 * time.Second
+	}
+	if S.DedupWindow <= 0 {
+		S.DedupWindow = 10 * time.Minute
+	}
+	if S.DedupMaxEntries <= 0 {
+		S.DedupMaxEntries = 100000
+	}
+	if S.ClockSampleWindow <= 0 {
+		S.ClockSampleWindow = 64
+	}
+	if S.ClockSkewThreshold <= 0 {
+		S.ClockSkewThreshold = 2 * time.Second
+	}
+	if S.ClockReportInterval <= 0 {
+		S.ClockReportInterval = time.Minute
+	}
+	if S.HandlerTimeout <= 0 {
+		S.HandlerTimeout = 30 * time.Second
+	}
+	if S.SlowHandlerThreshold <= 0 {
+		S.SlowHandlerThreshold = 5 * time.Second
+	}
+	if S.MaxPayloadSize <= 0 {
+		S.MaxPayloadSize = 256 * 1024
+	}
+	if S.StationConflictPolicy == "" {
+		S.StationConflictPolicy = "db-wins"
+	}
+	if S.ProvisioningPolicy == "" {
+		S.ProvisioningPolicy = "open"
+	}
+	if S.ClusterCreationPolicy == "" {
+		S.ClusterCreationPolicy = "disabled"
+	}
 }
 
 func (S *ServiceConfigImpl) Validate() error {
@@ -63,14 +168,74 @@ func (S *ServiceConfigImpl) Validate() error {
 		return fmt.Errorf("DEVICE_UPDATE_INTERVAL must be greater than 0")
 	}
 
-	if S.DeviceTimeoutDuration <= 0 {
-		return fmt.Errorf("DEVICE_TIMEOUT_DURATION must be greater than 0")
+	if S.DeviceTimeoutDuration <= S.DeviceUpdateInterval {
+		return fmt.Errorf("DEVICE_TIMEOUT_DURATION must be greater than DEVICE_UPDATE_INTERVAL")
 	}
 
 	if S.MaxConcurrentProcessing <= 0 {
 		return fmt.Errorf("MAX_CONCURRENT_PROCESSING must be greater than 0")
 	}
 
+	if S.ProcessingQueueDepth <= 0 {
+		return fmt.Errorf("PROCESSING_QUEUE_DEPTH must be greater than 0")
+	}
+
+	if !overflowPolicies[S.ProcessingOverflow] {
+		return fmt.Errorf("PROCESSING_OVERFLOW_POLICY must be one of: block, drop-oldest, dead-letter, got %s", S.ProcessingOverflow)
+	}
+
+	if S.DedupWindow <= 0 {
+		return fmt.Errorf("MEASUREMENT_DEDUP_WINDOW must be greater than 0")
+	}
+
+	if S.DedupMaxEntries <= 0 {
+		return fmt.Errorf("MEASUREMENT_DEDUP_MAX_ENTRIES must be greater than 0")
+	}
+
+	if S.ClockSampleWindow < 2 {
+		return fmt.Errorf("CLOCK_SAMPLE_WINDOW must be at least 2")
+	}
+
+	if S.ClockSkewThreshold <= 0 {
+		return fmt.Errorf("CLOCK_SKEW_WARN_THRESHOLD must be greater than 0")
+	}
+
+	if S.ClockReportInterval <= 0 {
+		return fmt.Errorf("CLOCK_REPORT_INTERVAL must be greater than 0")
+	}
+
+	if S.HandlerTimeout <= 0 {
+		return fmt.Errorf("HANDLER_TIMEOUT must be greater than 0")
+	}
+
+	if S.SlowHandlerThreshold <= 0 {
+		return fmt.Errorf("SLOW_HANDLER_THRESHOLD must be greater than 0")
+	}
+
+	if S.MaxPayloadSize <= 0 {
+		return fmt.Errorf("MAX_PAYLOAD_SIZE must be greater than 0")
+	}
+
+	if !conflictPolicies[S.StationConflictPolicy] {
+		return fmt.Errorf("STATION_CONFLICT_POLICY must be one of: db-wins, device-wins, last-writer-wins, got %s", S.StationConflictPolicy)
+	}
+
+	if !provisioningPolicies[S.ProvisioningPolicy] {
+		return fmt.Errorf("STATION_PROVISIONING_POLICY must be one of: open, allowlist, manual, got %s", S.ProvisioningPolicy)
+	}
+
+	if S.ProvisioningPolicy == "allowlist" && len(S.ProvisioningAllowlist) == 0 {
+		return fmt.Errorf("STATION_PROVISIONING_ALLOWLIST is required for the allowlist provisioning policy")
+	}
+
+	if !clusterCreationPolicies[S.ClusterCreationPolicy] {
+		return fmt.Errorf("CLUSTER_CREATION_POLICY must be one of: disabled, authorized, open, got %s", S.ClusterCreationPolicy)
+	}
+
+	if S.ClusterCreationPolicy == "authorized" && !S.ClusterRequestsEnabled {
+		return fmt.Errorf("CLUSTER_REQUESTS_ENABLED is required for the authorized cluster creation policy")
+	}
+
 	return nil
 }
 
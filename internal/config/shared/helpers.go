@@ -3,6 +3,7 @@ package shared
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -40,3 +41,32 @@ func GetEnvAsDuration(key string) time.Duration {
 
 	return time.Duration(0)
 }
+
+// GetEnvAsMap parses a comma separated list of key=value pairs.
+func GetEnvAsMap(key string) map[string]string {
+	result := make(map[string]string)
+
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		name, value, found := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			continue
+		}
+		result[name] = strings.TrimSpace(value)
+	}
+
+	return result
+}
+
+// GetEnvAsList parses a comma separated list, skipping empty entries.
+func GetEnvAsList(key string) []string {
+	var result []string
+
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
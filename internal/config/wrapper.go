@@ -1,8 +1,11 @@
 package config
 
 import (
+	"fmt"
 	"github.com/joho/godotenv"
 	"gps-no-sync/internal/config/components"
+	"gps-no-sync/internal/interfaces"
+	"sort"
 )
 
 type Wrapper interface {
@@ -11,6 +14,8 @@ type Wrapper interface {
 	GetInfluxConfig() components.InfluxConfigImpl
 	GetLoggerConfig() components.LoggerConfigImpl
 	GetServiceConfig() components.ServiceConfigImpl
+	GetLeaderConfig() components.LeaderConfigImpl
+	GetCommandConfig() components.CommandConfigImpl
 }
 
 type WrapperImpl struct {
@@ -19,6 +24,8 @@ type WrapperImpl struct {
 	InfluxConfig   components.InfluxConfigImpl   `json:"influx"`
 	LoggerConfig   components.LoggerConfigImpl   `json:"logger"`
 	ServiceConfig  components.ServiceConfigImpl  `json:"service"`
+	LeaderConfig   components.LeaderConfigImpl   `json:"leader"`
+	CommandConfig  components.CommandConfigImpl  `json:"command"`
 }
 
 func NewWrapper() WrapperImpl {
@@ -27,6 +34,8 @@ func NewWrapper() WrapperImpl {
 	influxConfig := components.NewInfluxConfig()
 	loggerConfig := components.NewLoggerConfig()
 	serviceConfig := components.NewServiceConfig()
+	leaderConfig := components.NewLeaderConfig()
+	commandConfig := components.NewCommandConfig()
 
 	return WrapperImpl{
 		MQTTConfig:     mqttConfig,
@@ -34,6 +43,8 @@ func NewWrapper() WrapperImpl {
 		InfluxConfig:   influxConfig,
 		LoggerConfig:   loggerConfig,
 		ServiceConfig:  serviceConfig,
+		LeaderConfig:   leaderConfig,
+		CommandConfig:  commandConfig,
 	}
 }
 
@@ -45,4 +56,37 @@ func (C WrapperImpl) Load() {
 	C.InfluxConfig.Load()
 	C.LoggerConfig.Load()
 	C.ServiceConfig.Load()
+	C.LeaderConfig.Load()
+	C.CommandConfig.Load()
+}
+
+// Validate checks every component and reports the first invalid one.
+func (C WrapperImpl) Validate() error {
+	return ValidateComponents(map[string]interfaces.Config{
+		"MQTT":     &C.MQTTConfig,
+		"Postgres": &C.PostgresConfig,
+		"InfluxDB": &C.InfluxConfig,
+		"logger":   &C.LoggerConfig,
+		"service":  &C.ServiceConfig,
+		"leader":   &C.LeaderConfig,
+		"command":  &C.CommandConfig,
+	})
+}
+
+// ValidateComponents checks the given components by name, in name order so the
+// reported error does not change between runs.
+func ValidateComponents(configs map[string]interfaces.Config) error {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := configs[name].Validate(); err != nil {
+			return fmt.Errorf("invalid %s configuration: %w", name, err)
+		}
+	}
+
+	return nil
 }
@@ -12,6 +12,14 @@ import (
 	"time"
 )
 
+// MeasurementPoint is a single point of a batched write.
+type MeasurementPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]interface{}
+	Timestamp   time.Time
+}
+
 type InfluxDB struct {
 	client       influxdb2.Client
 	writeAPI     api.WriteAPI
@@ -155,6 +163,42 @@ func (i *InfluxDB) WriteMeasurementSync(bucket, measurement string, tags map[str
 	return nil
 }
 
+// WriteMeasurementsSync writes all points in a single request.
+func (i *InfluxDB) WriteMeasurementsSync(bucket string, measurements []MeasurementPoint) error {
+	points := make([]*write.Point, 0, len(measurements))
+	for _, measurement := range measurements {
+		cleanFields := make(map[string]interface{})
+		for k, v := range measurement.Fields {
+			if v != nil {
+				cleanFields[k] = v
+			}
+		}
+
+		if len(cleanFields) == 0 {
+			return fmt.Errorf("no valid fields to write for measurement %s", measurement.Measurement)
+		}
+
+		points = append(points, influxdb2.NewPoint(measurement.Measurement, measurement.Tags, cleanFields, measurement.Timestamp))
+	}
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	writeAPI := i.client.WriteAPIBlocking(i.organization, bucket)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := writeAPI.WritePoint(ctx, points...); err != nil {
+		i.logger.Error().Err(err).Int("points", len(points)).Msg("Failed to write points synchronously")
+		return err
+	}
+
+	i.logger.Debug().Int("points", len(points)).Msg("Measurements written synchronously")
+	return nil
+}
+
 func (i *InfluxDB) Flush() {
 	i.writeAPI.Flush()
 }
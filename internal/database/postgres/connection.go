@@ -52,11 +52,47 @@ func NewConnection(cfg *components.PostgresConfigImpl) (*PostgresDB, error) {
 	return postgresDB, nil
 }
 
+// stationRevisionTriggerSQL increments the revision of a station whenever its
+// content changes without the writer setting a new revision, so edits made
+// directly in the database invalidate the revisions held by devices.
+const stationRevisionTriggerSQL = `
+CREATE OR REPLACE FUNCTION bump_station_revision() RETURNS trigger AS $$
+BEGIN
+	IF NEW.revision IS NOT DISTINCT FROM OLD.revision AND (
+		NEW.mac_address IS DISTINCT FROM OLD.mac_address OR
+		NEW.topic IS DISTINCT FROM OLD.topic OR
+		NEW.name IS DISTINCT FROM OLD.name OR
+		NEW.config::text IS DISTINCT FROM OLD.config::text OR
+		NEW.cluster_id IS DISTINCT FROM OLD.cluster_id OR
+		NEW.deleted_at IS DISTINCT FROM OLD.deleted_at
+	) THEN
+		NEW.revision := OLD.revision + 1;
+		NEW.updated_at := now();
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS stations_revision_trigger ON stations;
+CREATE TRIGGER stations_revision_trigger
+	BEFORE UPDATE ON stations
+	FOR EACH ROW EXECUTE FUNCTION bump_station_revision();`
+
 func (p *PostgresDB) migrate() error {
-	return p.db.AutoMigrate(
+	err := p.db.AutoMigrate(
 		&models.Cluster{},
 		&models.Station{},
+		&models.Command{},
 	)
+	if err != nil {
+		return err
+	}
+
+	if err := p.db.Exec(stationRevisionTriggerSQL).Error; err != nil {
+		return fmt.Errorf("failed to create station revision trigger: %w", err)
+	}
+
+	return nil
 }
 
 func (p *PostgresDB) GetDB() *gorm.DB {
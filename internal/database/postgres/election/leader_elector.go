@@ -0,0 +1,230 @@
+package election
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gps-no-sync/internal/config/components"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LeaderElector elects a single leader among all replicas by holding a
+// session-level Postgres advisory lock on a dedicated connection. Leadership
+// is lost as soon as that connection breaks.
+type LeaderElector struct {
+	db       *gorm.DB
+	enabled  bool
+	lockKey  int64
+	interval time.Duration
+	logger   zerolog.Logger
+
+	mu       sync.Mutex
+	conn     *sql.Conn
+	handlers []func(isLeader bool)
+	isLeader atomic.Bool
+	started  atomic.Bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewLeaderElector(db *gorm.DB, cfg *components.LeaderConfigImpl, logger zerolog.Logger) *LeaderElector {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &LeaderElector{
+		db:       db,
+		enabled:  cfg.Enabled,
+		lockKey:  cfg.LockKey,
+		interval: cfg.RetryInterval,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// OnLeadershipChange registers a callback that is invoked whenever this
+// instance gains or loses leadership.
+func (e *LeaderElector) OnLeadershipChange(handler func(isLeader bool)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.handlers = append(e.handlers, handler)
+}
+
+func (e *LeaderElector) IsLeader() bool {
+	return e.isLeader.Load()
+}
+
+func (e *LeaderElector) Start() {
+	e.started.Store(true)
+
+	if !e.enabled {
+		e.logger.Info().Msg("Leader election disabled, acting as leader")
+		e.setLeader(true)
+		close(e.done)
+		return
+	}
+
+	go e.run()
+}
+
+func (e *LeaderElector) Stop() {
+	e.cancel()
+	if !e.started.Load() {
+		return
+	}
+	<-e.done
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil {
+		e.closeConn(e.conn)
+		e.conn = nil
+	}
+
+	e.logger.Info().Msg("Leader elector stopped")
+}
+
+func (e *LeaderElector) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		e.tick()
+
+		select {
+		case <-ticker.C:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *LeaderElector) tick() {
+	ctx, cancel := context.WithTimeout(e.ctx, e.interval)
+	defer cancel()
+
+	if e.IsLeader() {
+		if err := e.holdLock(ctx); err != nil {
+			e.logger.Error().Err(err).Msg("Lost connection holding the leader lock")
+			e.releaseConn()
+			e.setLeader(false)
+		}
+		return
+	}
+
+	acquired, err := e.tryAcquire(ctx)
+	if err != nil {
+		e.logger.Error().Err(err).Msg("Failed to acquire leader lock")
+		return
+	}
+
+	if acquired {
+		e.setLeader(true)
+	}
+}
+
+func (e *LeaderElector) tryAcquire(ctx context.Context) (bool, error) {
+	sqlDB, err := e.db.DB()
+	if err != nil {
+		return false, fmt.Errorf("failed to get SQL DB: %w", err)
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get dedicated connection: %w", err)
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.lockKey).Scan(&acquired); err != nil {
+		// The lock may have been taken before the query failed.
+		discardConn(conn)
+		return false, fmt.Errorf("failed to query advisory lock: %w", err)
+	}
+
+	if !acquired {
+		_ = conn.Close()
+		return false, nil
+	}
+
+	e.mu.Lock()
+	e.conn = conn
+	e.mu.Unlock()
+
+	return true, nil
+}
+
+func (e *LeaderElector) holdLock(ctx context.Context) error {
+	e.mu.Lock()
+	conn := e.conn
+	e.mu.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("no connection holding the lock")
+	}
+
+	return conn.PingContext(ctx)
+}
+
+func (e *LeaderElector) releaseConn() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.conn != nil {
+		e.closeConn(e.conn)
+		e.conn = nil
+	}
+}
+
+// closeConn releases the leader lock and returns conn to the pool. The lock
+// belongs to the session, which outlives conn in the pool, so a connection
+// whose lock could not be released is discarded to end the session.
+func (e *LeaderElector) closeConn(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", e.lockKey); err != nil {
+		e.logger.Warn().Err(err).Msg("Failed to release leader lock, discarding its connection")
+		discardConn(conn)
+		return
+	}
+	_ = conn.Close()
+}
+
+// discardConn closes the physical connection behind conn instead of returning
+// it to the pool.
+func discardConn(conn *sql.Conn) {
+	_ = conn.Raw(func(driverConn any) error {
+		return driver.ErrBadConn
+	})
+	_ = conn.Close()
+}
+
+func (e *LeaderElector) setLeader(isLeader bool) {
+	if e.isLeader.Swap(isLeader) == isLeader {
+		return
+	}
+
+	e.logger.Info().
+		Bool("leader", isLeader).
+		Int64("lock_key", e.lockKey).
+		Msg("Leadership changed")
+
+	e.mu.Lock()
+	handlers := append([]func(bool){}, e.handlers...)
+	e.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(isLeader)
+	}
+}
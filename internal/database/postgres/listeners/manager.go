@@ -19,9 +19,10 @@ type ListenerManager struct {
 	cancel    context.CancelFunc
 	listeners map[string][]interfaces.ITableListener
 	channels  map[string]bool
+	isLeader  func() bool
 }
 
-func NewListenerManager(db *gorm.DB, dsn string, logger zerolog.Logger) *ListenerManager {
+func NewListenerManager(db *gorm.DB, dsn string, isLeader func() bool, logger zerolog.Logger) *ListenerManager {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	reportProblem := func(ev pq.ListenerEventType, err error) {
@@ -43,6 +44,7 @@ func NewListenerManager(db *gorm.DB, dsn string, logger zerolog.Logger) *Listene
 		cancel:    cancel,
 		listeners: make(map[string][]interfaces.ITableListener),
 		channels:  make(map[string]bool),
+		isLeader:  isLeader,
 	}
 }
 
@@ -163,6 +165,13 @@ func (lm *ListenerManager) listenForChanges() {
 }
 
 func (lm *ListenerManager) handleNotification(payload string) {
+	if lm.isLeader != nil && !lm.isLeader() {
+		lm.logger.Debug().
+			Str("component", "listener-manager").
+			Msg("Not the leader, ignoring table change notification")
+		return
+	}
+
 	var event interfaces.TableChangeEvent
 	if err := json.Unmarshal([]byte(payload), &event); err != nil {
 		lm.logger.Error().Err(err).
@@ -10,9 +10,17 @@ import (
 	"gps-no-sync/internal/models"
 	"gps-no-sync/internal/mq"
 	"gps-no-sync/internal/services"
+	"reflect"
 	"time"
 )
 
+// livenessColumns change with every heartbeat of a station and are not part of
+// the state synced to MQTT.
+var livenessColumns = map[string]bool{
+	"last_seen_at": true,
+	"online":       true,
+}
+
 type StationTableListener struct {
 	*BaseTableListener
 	logger            zerolog.Logger
@@ -40,6 +48,10 @@ func NewStationTableListener(
 }
 
 func (d *StationTableListener) HandleChange(ctx context.Context, event *interfaces.TableChangeEvent) error {
+	if event.Operation == interfaces.UpdateOperation && isLivenessUpdate(event) {
+		return nil
+	}
+
 	d.logger.Info().
 		Str("operation", string(event.Operation)).
 		Str("table", event.Table).
@@ -153,3 +165,16 @@ func (d *StationTableListener) handleDelete(ctx context.Context, event *interfac
 
 	return nil
 }
+
+// isLivenessUpdate reports whether an update only changed liveness columns.
+func isLivenessUpdate(event *interfaces.TableChangeEvent) bool {
+	for column, value := range event.NewData {
+		if livenessColumns[column] {
+			continue
+		}
+		if !reflect.DeepEqual(event.OldData[column], value) {
+			return false
+		}
+	}
+	return true
+}
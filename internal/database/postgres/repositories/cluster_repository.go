@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gps-no-sync/internal/models"
 )
 
@@ -44,7 +45,10 @@ func (r *ClusterRepository) FindById(ctx context.Context, id uint) (*models.Clus
 
 func (r *ClusterRepository) FindByTopic(ctx context.Context, topic string) (*models.Cluster, error) {
 	var cluster models.Cluster
-	err := r.db.WithContext(ctx).Preload("Stations").Where("topic = ?", topic).First(&cluster).Error
+	err := r.db.WithContext(ctx).
+		Preload("Stations", "provisioning_status = ?", models.ProvisioningApproved).
+		Where("topic = ?", topic).
+		First(&cluster).Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to find cluster by topic %s: %w", topic, err)
 	}
@@ -62,7 +66,9 @@ func (r *ClusterRepository) FindAll(ctx context.Context) ([]models.Cluster, erro
 
 func (r *ClusterRepository) FindAllWhereStationDeletedAtIsNull(ctx context.Context) ([]models.Cluster, error) {
 	var clusters []models.Cluster
-	err := r.db.WithContext(ctx).Preload("Stations", "deleted_at IS NULL").Find(&clusters).Error
+	err := r.db.WithContext(ctx).
+		Preload("Stations", "deleted_at IS NULL AND provisioning_status = ?", models.ProvisioningApproved).
+		Find(&clusters).Error
 	if err != nil {
 		return nil, fmt.Errorf("failed to get clusters with non-deleted stations: %w", err)
 	}
@@ -77,3 +83,86 @@ func (r *ClusterRepository) FindByName(ctx context.Context, name string) (*model
 	}
 	return &cluster, nil
 }
+
+// UpdateMembers makes stations with macAddresses the only members of the
+// cluster with id, moving them out of other clusters, in one transaction. The
+// current members and the requested stations are locked and passed to check,
+// which returns the stations to assign. Returning an error from it rolls the
+// transaction back.
+func (r *ClusterRepository) UpdateMembers(ctx context.Context, id uint, macAddresses []string, check func(members, requested []models.Station) ([]models.Station, error)) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return updateMembers(tx, id, macAddresses, check)
+	})
+}
+
+// CreateWithMembers stores cluster and assigns the stations with macAddresses
+// to it like UpdateMembers, in one transaction. It returns
+// gorm.ErrDuplicatedKey when a cluster with the same name exists.
+func (r *ClusterRepository) CreateWithMembers(ctx context.Context, cluster *models.Cluster, macAddresses []string, check func(members, requested []models.Station) ([]models.Station, error)) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Cluster{}).Where("name = ?", cluster.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return gorm.ErrDuplicatedKey
+		}
+
+		if err := tx.Create(cluster).Error; err != nil {
+			return err
+		}
+
+		return updateMembers(tx, cluster.ID, macAddresses, check)
+	})
+}
+
+func updateMembers(tx *gorm.DB, id uint, macAddresses []string, check func(members, requested []models.Station) ([]models.Station, error)) error {
+	locking := clause.Locking{Strength: "UPDATE"}
+
+	var members []models.Station
+	err := tx.Clauses(locking).
+		Where("cluster_id = ? AND deleted_at IS NULL", id).
+		Order("mac_address").
+		Find(&members).Error
+	if err != nil {
+		return err
+	}
+
+	var requested []models.Station
+	if len(macAddresses) > 0 {
+		err := tx.Clauses(locking).
+			Where("mac_address IN ? AND deleted_at IS NULL", macAddresses).
+			Order("mac_address").
+			Find(&requested).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	assigned, err := check(members, requested)
+	if err != nil {
+		return err
+	}
+
+	assignedIDs := make([]uint, len(assigned))
+	for i, station := range assigned {
+		assignedIDs[i] = station.ID
+	}
+
+	leaving := tx.Model(&models.Station{}).Where("cluster_id = ?", id)
+	if len(assignedIDs) > 0 {
+		leaving = leaving.Where("id NOT IN ?", assignedIDs)
+	}
+	if err := leaving.Update("cluster_id", nil).Error; err != nil {
+		return err
+	}
+
+	if len(assignedIDs) == 0 {
+		return nil
+	}
+
+	// Only touch stations that actually move, every update is synced to MQTT.
+	return tx.Model(&models.Station{}).
+		Where("id IN ? AND (cluster_id IS NULL OR cluster_id <> ?)", assignedIDs, id).
+		Update("cluster_id", id).Error
+}
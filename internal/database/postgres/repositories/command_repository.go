@@ -0,0 +1,72 @@
+package repositories
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gps-no-sync/internal/models"
+	"time"
+)
+
+type CommandRepository struct {
+	db *gorm.DB
+}
+
+func NewCommandRepository(db *gorm.DB) *CommandRepository {
+	return &CommandRepository{db: db}
+}
+
+func (r *CommandRepository) Create(ctx context.Context, command *models.Command) error {
+	return r.db.WithContext(ctx).Create(command).Error
+}
+
+// UpdatePending applies updates to a command that is still pending. It reports
+// false when the command was completed concurrently, e.g. by an ack arriving
+// while it was being resent.
+func (r *CommandRepository) UpdatePending(ctx context.Context, id uint, updates map[string]interface{}) (bool, error) {
+	result := r.db.WithContext(ctx).Model(&models.Command{}).
+		Where("id = ? AND status = ?", id, models.CommandStatusPending).
+		Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *CommandRepository) FindByCommandID(ctx context.Context, commandID string) (*models.Command, error) {
+	var command models.Command
+	err := r.db.WithContext(ctx).Where("command_id = ?", commandID).First(&command).Error
+	if err != nil {
+		return nil, err
+	}
+	return &command, nil
+}
+
+// FindDue returns pending commands whose next attempt is due at now, oldest
+// first.
+func (r *CommandRepository) FindDue(ctx context.Context, now time.Time, limit int) ([]models.Command, error) {
+	var commands []models.Command
+	err := r.db.WithContext(ctx).
+		Where("status = ? AND next_attempt_at <= ?", models.CommandStatusPending, now).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&commands).Error
+	if err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
+
+// FindByStation returns the latest commands of a station, or of all stations
+// when stationTopic is empty.
+func (r *CommandRepository) FindByStation(ctx context.Context, stationTopic string, limit int) ([]models.Command, error) {
+	query := r.db.WithContext(ctx).Order("created_at DESC").Limit(limit)
+	if stationTopic != "" {
+		query = query.Where("station_topic = ?", stationTopic)
+	}
+
+	var commands []models.Command
+	if err := query.Find(&commands).Error; err != nil {
+		return nil, err
+	}
+	return commands, nil
+}
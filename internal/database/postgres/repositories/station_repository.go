@@ -3,8 +3,12 @@ package repositories
 import (
 	"context"
 	"errors"
+	"fmt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gps-no-sync/internal/models"
+	"slices"
+	"time"
 )
 
 type StationRepository struct {
@@ -54,9 +58,85 @@ func (r *StationRepository) Update(ctx context.Context, station *models.Station)
 			"config":      station.Config,
 			"cluster_id":  station.ClusterID,
 			"mac_address": station.MacAddress,
+			"revision":    station.Revision,
 		}).Error
 }
 
+// UpdateByTopic locks the station published on topic id and saves the changes
+// update makes to it, all in one transaction. Returning an error from update
+// rolls the transaction back.
+func (r *StationRepository) UpdateByTopic(ctx context.Context, topic string, update func(station *models.Station) error) (*models.Station, error) {
+	var station models.Station
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("topic = ? AND deleted_at IS NULL", topic).
+			First(&station).Error
+		if err != nil {
+			return err
+		}
+
+		if err := update(&station); err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Station{}).
+			Where("id = ?", station.ID).
+			Updates(map[string]interface{}{
+				"name":       station.Name,
+				"config":     station.Config,
+				"cluster_id": station.ClusterID,
+				"revision":   station.Revision,
+				"updated_at": station.UpdatedAt,
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &station, nil
+}
+
+// MarkSeen records that the station published on topic id was active at
+// seenAt and reports whether it was offline before. Only the liveness columns
+// are written, so the update time and revision of the station stay unchanged.
+// Stations that are not approved never come online.
+func (r *StationRepository) MarkSeen(ctx context.Context, topic string, seenAt time.Time) (bool, error) {
+	db := r.db.WithContext(ctx)
+
+	result := db.Model(&models.Station{}).
+		Where("topic = ? AND deleted_at IS NULL AND NOT online AND provisioning_status = ?", topic, models.ProvisioningApproved).
+		UpdateColumns(map[string]interface{}{
+			"online":       true,
+			"last_seen_at": seenAt,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	err := db.Model(&models.Station{}).
+		Where("topic = ? AND deleted_at IS NULL AND (last_seen_at IS NULL OR last_seen_at < ?)", topic, seenAt).
+		UpdateColumn("last_seen_at", seenAt).Error
+	return false, err
+}
+
+// MarkOffline marks the online stations not seen since cutoff as offline and
+// returns them.
+func (r *StationRepository) MarkOffline(ctx context.Context, cutoff time.Time) ([]models.Station, error) {
+	var stations []models.Station
+	err := r.db.WithContext(ctx).Model(&stations).
+		Clauses(clause.Returning{}).
+		Where("online AND deleted_at IS NULL AND (last_seen_at IS NULL OR last_seen_at < ?)", cutoff).
+		UpdateColumn("online", false).Error
+	if err != nil {
+		return nil, err
+	}
+	return stations, nil
+}
+
 func (r *StationRepository) FindByMacAddress(ctx context.Context, macAddress string) (*models.Station, error) {
 	var device models.Station
 	err := r.db.WithContext(ctx).Preload("Cluster").Where("mac_address = ?", macAddress).First(&device).Error
@@ -66,6 +146,59 @@ func (r *StationRepository) FindByMacAddress(ctx context.Context, macAddress str
 	return &device, nil
 }
 
+// FindByTopic returns the station published on topic id, including soft
+// deleted stations.
+func (r *StationRepository) FindByTopic(ctx context.Context, topic string) (*models.Station, error) {
+	var station models.Station
+	err := r.db.WithContext(ctx).Where("topic = ?", topic).First(&station).Error
+	if err != nil {
+		return nil, err
+	}
+	return &station, nil
+}
+
+// SetProvisioningStatus moves the station with macAddress to status, provided
+// its current status is one of from. It returns gorm.ErrRecordNotFound when no
+// such station exists.
+func (r *StationRepository) SetProvisioningStatus(ctx context.Context, macAddress string, status models.ProvisioningStatus, from ...models.ProvisioningStatus) (*models.Station, error) {
+	var station models.Station
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("mac_address = ? AND deleted_at IS NULL", macAddress).
+			First(&station).Error
+		if err != nil {
+			return err
+		}
+
+		if !slices.Contains(from, station.ProvisioningStatus) {
+			return fmt.Errorf("station %s is %s", macAddress, station.ProvisioningStatus)
+		}
+
+		station.ProvisioningStatus = status
+		return tx.Model(&models.Station{}).
+			Where("id = ?", station.ID).
+			Update("provisioning_status", status).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &station, nil
+}
+
+func (r *StationRepository) FindByProvisioningStatus(ctx context.Context, status models.ProvisioningStatus) ([]models.Station, error) {
+	var stations []models.Station
+	err := r.db.WithContext(ctx).
+		Where("provisioning_status = ? AND deleted_at IS NULL", status).
+		Order("created_at").
+		Find(&stations).Error
+	if err != nil {
+		return nil, err
+	}
+	return stations, nil
+}
+
 func (r *StationRepository) FindAllWhereIsNotDeleted(ctx context.Context) ([]models.Station, error) {
 	var stations []models.Station
 	err := r.db.WithContext(ctx).Preload("Cluster").Where("deleted_at IS NULL").Find(&stations).Error
@@ -14,19 +14,22 @@ type Cluster struct {
 }
 
 type ClusterDto struct {
-	Name     string   `json:"name"`
-	Stations []string `json:"stations"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Stations is nil when a document leaves out the stations key, or sets it
+	// to null, and the members of the cluster stay unchanged.
+	Stations *[]string `json:"stations"`
 }
 
 func (c *Cluster) ToDto() *ClusterDto {
-	clusterDto := &ClusterDto{
-		Name:     c.Name,
-		Stations: make([]string, len(c.Stations)),
-	}
-
+	stations := make([]string, len(c.Stations))
 	for i, station := range c.Stations {
-		clusterDto.Stations[i] = station.MacAddress
+		stations[i] = station.MacAddress
 	}
 
-	return clusterDto
+	return &ClusterDto{
+		Name:        c.Name,
+		Description: c.Description,
+		Stations:    &stations,
+	}
 }
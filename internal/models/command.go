@@ -0,0 +1,111 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type CommandName string
+
+const (
+	CommandReboot       CommandName = "reboot"
+	CommandStartRanging CommandName = "start_ranging"
+	CommandStopRanging  CommandName = "stop_ranging"
+	CommandSetMode      CommandName = "set_mode"
+	CommandIdentify     CommandName = "identify"
+)
+
+var CommandNames = []CommandName{
+	CommandReboot,
+	CommandStartRanging,
+	CommandStopRanging,
+	CommandSetMode,
+	CommandIdentify,
+}
+
+type CommandStatus string
+
+const (
+	CommandStatusPending  CommandStatus = "pending"
+	CommandStatusAcked    CommandStatus = "acked"
+	CommandStatusFailed   CommandStatus = "failed"
+	CommandStatusTimedOut CommandStatus = "timed_out"
+)
+
+// JSONMap is a free-form JSON object stored as jsonb.
+type JSONMap map[string]interface{}
+
+func (m JSONMap) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	return json.Marshal(m)
+}
+
+func (m *JSONMap) Scan(value interface{}) error {
+	if value == nil {
+		*m = nil
+		return nil
+	}
+
+	var bytes []byte
+	switch v := value.(type) {
+	case []byte:
+		bytes = v
+	case string:
+		bytes = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into JSONMap", value)
+	}
+
+	return json.Unmarshal(bytes, m)
+}
+
+// Command is an instruction sent to a station on its cmd topic. It stays
+// pending until the station acknowledges it or all attempts timed out.
+type Command struct {
+	ID            uint          `gorm:"primaryKey" json:"-"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	CommandID     string        `gorm:"uniqueIndex;not null" json:"id"`
+	StationTopic  string        `gorm:"index;not null" json:"station"`
+	Name          CommandName   `gorm:"not null" json:"command"`
+	Params        JSONMap       `gorm:"type:jsonb" json:"params,omitempty"`
+	Status        CommandStatus `gorm:"index;not null" json:"status"`
+	Attempts      int           `json:"attempts"`
+	MaxAttempts   int           `json:"max_attempts"`
+	LastSentAt    *time.Time    `json:"last_sent_at,omitempty"`
+	NextAttemptAt *time.Time    `gorm:"index" json:"next_attempt_at,omitempty"`
+	CompletedAt   *time.Time    `json:"completed_at,omitempty"`
+	Result        JSONMap       `gorm:"type:jsonb" json:"result,omitempty"`
+	Error         string        `gorm:"type:text" json:"error,omitempty"`
+}
+
+func (Command) TableName() string {
+	return "station_commands"
+}
+
+func (c *Command) Validate() error {
+	if c.StationTopic == "" {
+		return fmt.Errorf("station is required")
+	}
+
+	switch c.Name {
+	case CommandReboot, CommandStartRanging, CommandStopRanging, CommandIdentify:
+		return nil
+	case CommandSetMode:
+		mode, _ := c.Params["mode"].(string)
+		if DW3000Mode(mode) != DW3000ModeAnchor && DW3000Mode(mode) != DW3000ModeTag {
+			return fmt.Errorf("set_mode requires param mode %s or %s", DW3000ModeAnchor, DW3000ModeTag)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", c.Name)
+	}
+}
+
+func (c *Command) IsCompleted() bool {
+	return c.Status != CommandStatusPending
+}
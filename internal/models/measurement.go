@@ -20,6 +20,9 @@ type Measurement struct {
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
 	Timestamp  time.Time              `json:"timestamp"`
 	ReceivedAt time.Time              `json:"received_at"`
+	// RawTimestamp is the timestamp reported by the device before clock
+	// correction, zero when the device did not send one.
+	RawTimestamp time.Time `json:"-"`
 }
 
 type UWBDistanceMeasurement struct {
@@ -67,6 +70,10 @@ func (m *Measurement) GetFields() map[string]interface{} {
 
 	fields["unit"] = m.Unit
 
+	if !m.RawTimestamp.IsZero() {
+		fields["raw_timestamp"] = m.RawTimestamp.UnixNano()
+	}
+
 	return fields
 }
 
@@ -17,6 +17,16 @@ const (
 	DW3000ModeUnknown DW3000Mode = "UNKNOWN"
 )
 
+// ProvisioningStatus tells whether a station may take part in the fleet.
+// Stations that are not approved are stored but not published.
+type ProvisioningStatus string
+
+const (
+	ProvisioningApproved ProvisioningStatus = "approved"
+	ProvisioningPending  ProvisioningStatus = "pending"
+	ProvisioningRejected ProvisioningStatus = "rejected"
+)
+
 type StationConfig struct {
 	UWB *UWBConfig `json:"uwb,omitempty"`
 }
@@ -58,6 +68,19 @@ type Station struct {
 	Config     StationConfig `gorm:"type:jsonb" json:"config"`
 	ClusterID  *uint         `json:"cluster_id"`
 	Cluster    *Cluster      `gorm:"foreignKey:ClusterID"`
+	// Revision is incremented on every change of the station, see
+	// postgres.stationRevisionTriggerSQL.
+	Revision uint64 `gorm:"not null;default:0" json:"revision"`
+	// LastSeenAt and Online track the liveness of the station and are not part
+	// of its synced state.
+	LastSeenAt *time.Time `gorm:"index" json:"last_seen_at"`
+	Online     bool       `gorm:"not null;default:false" json:"online"`
+
+	ProvisioningStatus ProvisioningStatus `gorm:"not null;default:approved;index" json:"provisioning_status"`
+}
+
+func (s *Station) IsApproved() bool {
+	return s.ProvisioningStatus == ProvisioningApproved
 }
 
 func (s *Station) IsValid() bool {
@@ -102,8 +125,12 @@ func (s *Station) UpdateFromDto(dto *StationDto) {
 	s.Config = dto.Config
 }
 
+// IsEqual compares the content of the station with other, ignoring revision
+// and update time.
 func (s *Station) IsEqual(other StationDto) bool {
 	stationDto := s.ToDto()
+	stationDto.Revision, other.Revision = nil, nil
+	stationDto.UpdatedAt, other.UpdatedAt = nil, nil
 
 	byteStation, err1 := json.Marshal(stationDto)
 	byteOther, err2 := json.Marshal(other)
@@ -116,11 +143,14 @@ func (s *Station) IsEqual(other StationDto) bool {
 }
 
 func (s *Station) ToDto() *StationDto {
+	revision := s.Revision
 	return &StationDto{
 		MacAddress: s.MacAddress,
 		Name:       s.Name,
 		ClusterID:  s.ClusterID,
 		Config:     s.Config,
+		Revision:   &revision,
+		UpdatedAt:  s.UpdatedAt,
 	}
 }
 
@@ -129,6 +159,19 @@ type StationDto struct {
 	Name       string        `json:"name"`
 	ClusterID  *uint         `json:"cluster_id"`
 	Config     StationConfig `json:"config"`
+	// Revision is the revision the sender based its state on. It is nil for
+	// senders that do not track revisions, such as older firmware.
+	Revision  *uint64    `json:"revision,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// BaseRevision returns the revision the sender based its state on, or 0 when
+// it did not send one.
+func (s *StationDto) BaseRevision() uint64 {
+	if s.Revision == nil {
+		return 0
+	}
+	return *s.Revision
 }
 
 func (s *StationDto) ToStation() *Station {
@@ -3,24 +3,36 @@ package mq
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"gps-no-sync/internal/config/components"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ErrNoResponseTopic = errors.New("message has no response topic")
+
 type Message struct {
-	Data   interface{} `json:"data"`
-	Source string      `json:"source"`
+	Data interface{} `json:"data"`
+	Provenance
 }
 
 type MessageOptions struct {
-	Qos      byte          `json:"qos"`
-	Retained bool          `json:"retained"`
-	Timeout  time.Duration `json:"timeout"`
-	Source   string        `json:"source"`
+	Qos             byte              `json:"qos"`
+	Retained        bool              `json:"retained"`
+	Timeout         time.Duration     `json:"timeout"`
+	Source          string            `json:"source"`
+	ContentType     string            `json:"content_type,omitempty"`
+	MessageExpiry   time.Duration     `json:"message_expiry,omitempty"`
+	ResponseTopic   string            `json:"response_topic,omitempty"`
+	CorrelationData []byte            `json:"correlation_data,omitempty"`
+	UserProperties  map[string]string `json:"user_properties,omitempty"`
+	Provenance      *Provenance       `json:"-"`
 }
 
 func DefaultMessageOptions() *MessageOptions {
@@ -28,60 +40,114 @@ func DefaultMessageOptions() *MessageOptions {
 		Qos:      0,
 		Retained: true,
 		Timeout:  5 * time.Second,
-		Source:   "SYNC",
+		Source:   SourceSync,
 	}
 }
 
-type Client struct {
-	client    mqtt.Client
-	config    components.MQTTConfig
-	logger    zerolog.Logger
-	connected bool
+type subscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
 }
 
-func NewClient(cfg *components.MQTTConfigImpl, logger zerolog.Logger) (*Client, error) {
-	opts := mqtt.NewClientOptions()
+type Client struct {
+	transport         transport
+	config            components.MQTTConfig
+	logger            zerolog.Logger
+	connected         bool
+	protocolVersion   int
+	measurementExpiry time.Duration
+	instanceID        string
+	presence          *presence
+	maxHops           int
+	sequence          atomic.Uint64
+
+	mu                sync.RWMutex
+	subscriptions     map[string]subscription
+	reconnectHandlers []func()
+	hasConnected      bool
+
+	outbox  *Outbox
+	drainMu sync.Mutex
+}
 
-	opts.AddBroker(cfg.Url)
+func NewClient(cfg *components.MQTTConfigImpl, serviceCfg *components.ServiceConfigImpl, logger zerolog.Logger) (*Client, error) {
 	clientID := fmt.Sprintf("%s-%d", cfg.ClientID, rand.Intn(10000))
-	opts.SetClientID(clientID)
+	instanceID := uuid.NewString()
 
-	if cfg.Username != "" && cfg.Password != "" {
-		opts.SetUsername(cfg.Username)
-		opts.SetPassword(cfg.Password)
+	mqttClient := &Client{
+		config:            cfg,
+		logger:            logger,
+		connected:         false,
+		protocolVersion:   cfg.ProtocolVersion,
+		measurementExpiry: cfg.MeasurementExpiry,
+		instanceID:        instanceID,
+		maxHops:           cfg.MaxHops,
+		subscriptions:     make(map[string]subscription),
 	}
 
-	opts.SetKeepAlive(cfg.KeepAlive)
-	opts.SetAutoReconnect(cfg.AutoReconnect)
-	opts.SetMaxReconnectInterval(cfg.MaxReconnectInterval)
-	opts.SetCleanSession(cfg.CleanSession)
+	// Short-lived tools disable presence, so they neither announce themselves
+	// nor overwrite the status of the service running under the same name.
+	var will *willMessage
+	if cfg.PresenceEnabled {
+		mqttClient.presence = newPresence(cfg.BaseTopic, cfg.InstanceName, clientID, instanceID, serviceCfg.Version)
 
-	mqttClient := &Client{
-		logger:    logger,
-		connected: false,
+		willPayload, err := mqttClient.encodeJson(mqttClient.presence.status(ServiceStatusOffline, nil), DefaultMessageOptions())
+		if err != nil {
+			return nil, fmt.Errorf("could not encode last will: %w", err)
+		}
+		will = &willMessage{
+			topic:   mqttClient.presence.topic,
+			payload: willPayload,
+		}
+	}
+
+	if cfg.OutboxEnabled {
+		outbox, err := NewOutbox(cfg.OutboxPath, cfg.OutboxMaxEntries, logger.With().Str("subcomponent", "outbox").Logger())
+		if err != nil {
+			return nil, fmt.Errorf("could not open MQTT outbox: %w", err)
+		}
+		mqttClient.outbox = outbox
+	}
+
+	if cfg.TLSEnabled && cfg.TLSInsecureSkip {
+		logger.Warn().Msg("TLS certificate verification is disabled for the MQTT broker")
+	}
+
+	callbacks := transportCallbacks{
+		onConnect:        mqttClient.onConnect,
+		onConnectionLost: mqttClient.onConnectionLost,
 	}
 
-	opts.SetOnConnectHandler(mqttClient.onConnect)
-	opts.SetConnectionLostHandler(mqttClient.onConnectionLost)
+	var err error
+	switch cfg.ProtocolVersion {
+	case ProtocolVersion5:
+		mqttClient.transport, err = newV5Transport(cfg, clientID, will, callbacks)
+	default:
+		mqttClient.transport, err = newV3Transport(cfg, clientID, will, callbacks)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not create MQTT transport: %w", err)
+	}
 
-	mqttClient.client = mqtt.NewClient(opts)
+	logger.Info().
+		Str("client_id", clientID).
+		Str("instance_id", instanceID).
+		Int("protocol_version", cfg.ProtocolVersion).
+		Msg("Created MQTT client")
 
 	return mqttClient, nil
 }
 
 func (c *Client) Connect(ctx context.Context) error {
-	token := c.client.Connect()
-
-	select {
-	case <-token.Done():
-		if token.Error() != nil {
-			return fmt.Errorf("error connecting to MQTTConfig broker: %w", token.Error())
+	if err := c.transport.Connect(ctx); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("connection to MQTTConfig broker timed out: %w", ctx.Err())
 		}
-		c.connected = true
-		return nil
-	case <-ctx.Done():
-		return fmt.Errorf("connection to MQTTConfig broker timed out: %w", ctx.Err())
+		return fmt.Errorf("error connecting to MQTTConfig broker: %w", err)
 	}
+
+	c.connected = true
+	return nil
 }
 
 func (c *Client) Disconnect(ctx context.Context) {
@@ -90,7 +156,7 @@ func (c *Client) Disconnect(ctx context.Context) {
 		return
 	}
 
-	c.client.Disconnect(250)
+	c.transport.Disconnect(ctx)
 
 	select {
 	case <-ctx.Done():
@@ -101,16 +167,103 @@ func (c *Client) Disconnect(ctx context.Context) {
 	}
 }
 
+func (c *Client) ProtocolVersion() int {
+	return c.protocolVersion
+}
+
+func (c *Client) InstanceID() string {
+	return c.instanceID
+}
+
+// AnnouncePresence publishes the retained online status document of this
+// instance. It is repeated automatically after every reconnect.
+func (c *Client) AnnouncePresence() error {
+	return c.publishStatus(ServiceStatusOnline)
+}
+
+// SetLeader records whether this instance currently holds leadership and
+// republishes the status document so dashboards can see it.
+func (c *Client) SetLeader(isLeader bool) error {
+	if c.presence == nil {
+		return nil
+	}
+	c.presence.leader.Store(isLeader)
+
+	if !c.IsConnected() {
+		return nil
+	}
+	return c.AnnouncePresence()
+}
+
+// PublishOffline marks this instance as offline before a clean shutdown, as the
+// broker only sends the last will when the connection drops unexpectedly.
+func (c *Client) PublishOffline() error {
+	return c.publishStatus(ServiceStatusOffline)
+}
+
+func (c *Client) publishStatus(status string) error {
+	if c.presence == nil {
+		return nil
+	}
+
+	c.mu.RLock()
+	topics := make([]string, 0, len(c.subscriptions))
+	for topic := range c.subscriptions {
+		topics = append(topics, topic)
+	}
+	c.mu.RUnlock()
+
+	options := DefaultMessageOptions()
+	options.Qos = 1
+
+	if err := c.PublishJsonWithOptions(c.presence.topic, c.presence.status(status, topics), options); err != nil {
+		return fmt.Errorf("failed to publish service status: %w", err)
+	}
+
+	return nil
+}
+
 func (c *Client) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
-	if !c.client.IsConnected() {
-		return fmt.Errorf("MQTTConfig client is not connected, cannot subscribe to topic %s", topic)
+	c.mu.Lock()
+	c.subscriptions[topic] = subscription{qos: qos, handler: handler}
+	c.mu.Unlock()
+
+	if !c.transport.IsConnected() {
+		c.logger.Warn().Str("topic", topic).Msg("Client is not connected, subscription will be applied on connect")
+		return nil
+	}
+
+	return c.subscribe(topic, qos, handler)
+}
+
+func (c *Client) Unsubscribe(topic string) error {
+	c.mu.Lock()
+	delete(c.subscriptions, topic)
+	c.mu.Unlock()
+
+	if !c.transport.IsConnected() {
+		return nil
+	}
+
+	if err := c.transport.Unsubscribe(topic); err != nil {
+		return fmt.Errorf("error unsubscribing from topic %s: %w", topic, err)
 	}
 
-	token := c.client.Subscribe(topic, qos, handler)
-	token.Wait()
+	return nil
+}
+
+// OnReconnect registers a callback that runs every time the client re-establishes
+// a lost connection, after all registered subscriptions have been restored.
+func (c *Client) OnReconnect(handler func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reconnectHandlers = append(c.reconnectHandlers, handler)
+}
 
-	if token.Error() != nil {
-		return fmt.Errorf("error subscribing to topic %s: %w", topic, token.Error())
+func (c *Client) subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	if err := c.transport.Subscribe(topic, qos, handler); err != nil {
+		return fmt.Errorf("error subscribing to topic %s: %w", topic, err)
 	}
 
 	c.logger.Info().Str("topic", topic).Msg("Added topic subscription")
@@ -119,15 +272,24 @@ func (c *Client) Subscribe(topic string, qos byte, handler mqtt.MessageHandler)
 }
 
 func (c *Client) PublishWithOptions(topic string, payload []byte, options *MessageOptions) error {
+	// While older publishes are still waiting in the outbox, newer retained values
+	// have to queue behind them so the broker never ends up with a stale state.
+	if c.isDurable(topic, options) && (!c.IsConnected() || c.outbox.Len() > 0) {
+		return c.enqueue(topic, payload, options)
+	}
+
 	if !c.IsConnected() {
 		return fmt.Errorf("MQTTConfig client is not connected")
 	}
 
-	token := c.client.Publish(topic, options.Qos, options.Retained, payload)
-	token.WaitTimeout(options.Timeout)
-
-	if token.Error() != nil {
-		return fmt.Errorf("failed to publish to topic %s: %w", topic, token.Error())
+	if err := c.publish(topic, payload, options); err != nil {
+		if c.isDurable(topic, options) {
+			c.logger.Warn().Err(err).
+				Str("topic", topic).
+				Msg("Publish failed, queueing message in outbox")
+			return c.enqueue(topic, payload, options)
+		}
+		return err
 	}
 
 	c.logger.Debug().
@@ -138,11 +300,84 @@ func (c *Client) PublishWithOptions(topic string, payload []byte, options *Messa
 	return nil
 }
 
-func (c *Client) Publish(topic string, payload []byte) error {
-	if !c.IsConnected() {
-		return fmt.Errorf("MQTTConfig client is not connected")
+func (c *Client) publish(topic string, payload []byte, options *MessageOptions) error {
+	if err := c.transport.Publish(topic, payload, options); err != nil {
+		return fmt.Errorf("failed to publish to topic %s: %w", topic, err)
 	}
 
+	return nil
+}
+
+func (c *Client) isDurable(topic string, options *MessageOptions) bool {
+	return c.outbox != nil && options.Retained && isOutboxTopic(topic)
+}
+
+func (c *Client) enqueue(topic string, payload []byte, options *MessageOptions) error {
+	if err := c.outbox.Enqueue(topic, payload, options); err != nil {
+		return fmt.Errorf("failed to queue message for topic %s: %w", topic, err)
+	}
+
+	c.logger.Debug().
+		Str("topic", topic).
+		Int("pending", c.outbox.Len()).
+		Msg("Queued message in outbox")
+
+	if c.IsConnected() {
+		go c.drainOutbox()
+	}
+
+	return nil
+}
+
+func (c *Client) drainOutbox() {
+	if c.outbox == nil || !c.drainMu.TryLock() {
+		return
+	}
+	defer c.drainMu.Unlock()
+
+	for c.IsConnected() {
+		pending := c.outbox.Pending()
+		if len(pending) == 0 {
+			return
+		}
+
+		delivered := make([]outboxEntry, 0, len(pending))
+		for _, entry := range pending {
+			options, valid := entry.replayOptions(time.Now())
+			if !valid {
+				c.logger.Debug().
+					Str("topic", entry.Topic).
+					Time("queued_at", entry.QueuedAt).
+					Msg("Dropped expired message from outbox")
+				delivered = append(delivered, entry)
+				continue
+			}
+
+			if err := c.publish(entry.Topic, entry.Payload, options); err != nil {
+				c.logger.Warn().Err(err).
+					Str("topic", entry.Topic).
+					Msg("Failed to drain outbox, will retry on next connect")
+				break
+			}
+			delivered = append(delivered, entry)
+		}
+
+		if err := c.outbox.Remove(delivered); err != nil {
+			c.logger.Error().Err(err).Msg("Failed to persist outbox after draining")
+		}
+
+		c.logger.Info().
+			Int("delivered", len(delivered)).
+			Int("pending", c.outbox.Len()).
+			Msg("Drained outbox")
+
+		if len(delivered) < len(pending) {
+			return
+		}
+	}
+}
+
+func (c *Client) Publish(topic string, payload []byte) error {
 	msgOptions := DefaultMessageOptions()
 
 	err := c.PublishWithOptions(topic, payload, msgOptions)
@@ -159,38 +394,161 @@ func (c *Client) Publish(topic string, payload []byte) error {
 }
 
 func (c *Client) PublishJson(topic string, data interface{}) error {
-	msgOptions := &MessageOptions{
-		Qos:      0,
-		Retained: true,
-		Timeout:  5 * time.Second,
-		Source:   "SYNC",
+	return c.PublishJsonWithOptions(topic, data, DefaultMessageOptions())
+}
+
+// PublishJsonContext publishes data like PublishJson, but when ctx carries the
+// provenance of an inbound message the publish inherits its correlation id and
+// counts as one more hop.
+func (c *Client) PublishJsonContext(ctx context.Context, topic string, data interface{}) error {
+	options := DefaultMessageOptions()
+	provenance := c.newProvenance(ctx, options.Source)
+	options.Provenance = &provenance
+
+	return c.PublishJsonWithOptions(topic, data, options)
+}
+
+// IsEcho reports whether a message has to be ignored, either because this
+// instance published it or because it exceeded the maximum number of hops.
+func (c *Client) IsEcho(provenance Provenance) bool {
+	if provenance.Origin != "" && provenance.Origin == c.instanceID {
+		return true
+	}
+
+	return c.maxHops > 0 && provenance.Hops >= c.maxHops
+}
+
+func (c *Client) newProvenance(ctx context.Context, source string) Provenance {
+	provenance := Provenance{
+		Source:        source,
+		Origin:        c.instanceID,
+		Sequence:      c.sequence.Add(1),
+		CorrelationID: uuid.NewString(),
+	}
+
+	if parent, ok := ProvenanceFromContext(ctx); ok {
+		if parent.CorrelationID != "" {
+			provenance.CorrelationID = parent.CorrelationID
+		}
+		provenance.Hops = parent.Hops + 1
 	}
 
-	message := Message{
-		Data:   data,
-		Source: msgOptions.Source,
+	return provenance
+}
+
+// PublishJsonWithOptions wraps data in the Message envelope for MQTT 3. With
+// MQTT 5 the payload is published bare and the provenance travels as user
+// properties instead.
+func (c *Client) PublishJsonWithOptions(topic string, data interface{}, options *MessageOptions) error {
+	payload, err := c.encodeJson(data, options)
+	if err != nil {
+		return err
+	}
+
+	return c.PublishWithOptions(topic, payload, options)
+}
+
+func (c *Client) encodeJson(data interface{}, options *MessageOptions) ([]byte, error) {
+	if options.Provenance == nil {
+		provenance := c.newProvenance(context.Background(), options.Source)
+		options.Provenance = &provenance
+	}
+
+	var message interface{} = Message{
+		Data:       data,
+		Provenance: *options.Provenance,
+	}
+
+	if c.protocolVersion == ProtocolVersion5 {
+		message = data
+		options.ContentType = ContentTypeJSON
+		if options.UserProperties == nil {
+			options.UserProperties = make(map[string]string)
+		}
+		for key, value := range options.Provenance.userProperties() {
+			options.UserProperties[key] = value
+		}
 	}
 
 	payload, err := json.Marshal(message)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	return payload, nil
+}
+
+// MeasurementMessageOptions returns the options used for publishing measurement
+// payloads, which expire on the broker instead of piling up for offline consumers.
+func (c *Client) MeasurementMessageOptions() *MessageOptions {
+	options := DefaultMessageOptions()
+	options.Qos = 1
+	options.Retained = false
+	options.MessageExpiry = c.measurementExpiry
+	return options
+}
+
+// Reply publishes data to the response topic of an MQTT 5 request, echoing its
+// correlation data. MQTT 3 requests carry no response topic and cannot be answered.
+func (c *Client) Reply(request mqtt.Message, data interface{}) error {
+	properties := PropertiesOf(request)
+	if properties == nil || properties.ResponseTopic == "" {
+		return ErrNoResponseTopic
 	}
 
-	return c.PublishWithOptions(topic, payload, msgOptions)
+	options := DefaultMessageOptions()
+	options.Retained = false
+	options.CorrelationData = properties.CorrelationData
+
+	return c.PublishJsonWithOptions(properties.ResponseTopic, data, options)
 }
 
 func (c *Client) IsConnected() bool {
-	return c.connected && c.client.IsConnected()
+	return c.connected && c.transport.IsConnected()
 }
 
-func (c *Client) onConnect(client mqtt.Client) {
+func (c *Client) onConnect() {
 	c.connected = true
 
+	c.mu.Lock()
+	isReconnect := c.hasConnected
+	c.hasConnected = true
+	subscriptions := make(map[string]subscription, len(c.subscriptions))
+	for topic, sub := range c.subscriptions {
+		subscriptions[topic] = sub
+	}
+	reconnectHandlers := append([]func(){}, c.reconnectHandlers...)
+	c.mu.Unlock()
+
 	c.logger.Info().
+		Bool("reconnect", isReconnect).
+		Int("subscriptions", len(subscriptions)).
 		Msg("Successfully connected to broker")
+
+	for topic, sub := range subscriptions {
+		if err := c.subscribe(topic, sub.qos, sub.handler); err != nil {
+			c.logger.Error().Err(err).
+				Str("topic", topic).
+				Msg("Failed to restore subscription")
+		}
+	}
+
+	c.drainOutbox()
+
+	if err := c.AnnouncePresence(); err != nil {
+		c.logger.Error().Err(err).Msg("Failed to announce service presence")
+	}
+
+	if !isReconnect {
+		return
+	}
+
+	for _, handler := range reconnectHandlers {
+		handler()
+	}
 }
 
-func (c *Client) onConnectionLost(client mqtt.Client, err error) {
+func (c *Client) onConnectionLost(err error) {
 	c.connected = false
 	c.logger.Warn().Err(err).Msg("lost connection to broker")
 }
@@ -0,0 +1,23 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"reflect"
+)
+
+const EncodingCBOR = "cbor"
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}{}),
+}.DecMode()
+
+func transcodeCBOR(payload []byte) ([]byte, error) {
+	var value interface{}
+	if err := cborDecMode.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("invalid CBOR payload: %w", err)
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,18 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const EncodingMsgPack = "msgpack"
+
+func transcodeMsgPack(payload []byte) ([]byte, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(payload, &value); err != nil {
+		return nil, fmt.Errorf("invalid MessagePack payload: %w", err)
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,183 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"time"
+)
+
+const EncodingProtobuf = "protobuf"
+
+type protoField struct {
+	number protowire.Number
+	typ    protowire.Type
+	varint uint64
+	fixed  uint64
+	bytes  []byte
+}
+
+// transcodeProtobuf decodes a gpsno.v1.MeasurementBatch as published in
+// schemas/v1/measurement.proto.
+func transcodeProtobuf(payload []byte) ([]byte, error) {
+	measurements := make([]interface{}, 0)
+
+	err := protoFields(payload, func(field protoField) error {
+		if field.number != 1 {
+			return nil
+		}
+		if field.typ != protowire.BytesType {
+			return fmt.Errorf("field measurements has wire type %d", field.typ)
+		}
+
+		measurement, err := decodeProtoMeasurement(field.bytes)
+		if err != nil {
+			return fmt.Errorf("measurement %d: %w", len(measurements), err)
+		}
+		measurements = append(measurements, measurement)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid Protobuf payload: %w", err)
+	}
+
+	return json.Marshal(map[string]interface{}{"measurements": measurements})
+}
+
+func decodeProtoMeasurement(b []byte) (map[string]interface{}, error) {
+	measurement := make(map[string]interface{})
+	metadata := make(map[string]interface{})
+
+	err := protoFields(b, func(field protoField) error {
+		switch field.number {
+		case 1, 2, 3, 6, 7:
+			if field.typ != protowire.BytesType {
+				return fmt.Errorf("field %d has wire type %d", field.number, field.typ)
+			}
+			name := map[protowire.Number]string{1: "id", 2: "station_id", 3: "type", 6: "value", 7: "unit"}[field.number]
+			measurement[name] = string(field.bytes)
+		case 4:
+			if field.typ != protowire.BytesType {
+				return fmt.Errorf("field uwb has wire type %d", field.typ)
+			}
+			uwb, err := decodeProtoUWBDistance(field.bytes)
+			if err != nil {
+				return fmt.Errorf("uwb: %w", err)
+			}
+			measurement["value"] = uwb
+		case 5:
+			if field.typ != protowire.Fixed64Type {
+				return fmt.Errorf("field number has wire type %d", field.typ)
+			}
+			measurement["value"] = math.Float64frombits(field.fixed)
+		case 8:
+			if field.typ != protowire.VarintType {
+				return fmt.Errorf("field timestamp_ms has wire type %d", field.typ)
+			}
+			if millis := int64(field.varint); millis != 0 {
+				measurement["timestamp"] = time.UnixMilli(millis).UTC().Format(time.RFC3339Nano)
+			}
+		case 9:
+			if field.typ != protowire.BytesType {
+				return fmt.Errorf("field metadata has wire type %d", field.typ)
+			}
+			var key, value string
+			err := protoFields(field.bytes, func(entry protoField) error {
+				switch entry.number {
+				case 1:
+					key = string(entry.bytes)
+				case 2:
+					value = string(entry.bytes)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("metadata: %w", err)
+			}
+			metadata[key] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata) > 0 {
+		measurement["metadata"] = metadata
+	}
+
+	return measurement, nil
+}
+
+func decodeProtoUWBDistance(b []byte) (map[string]interface{}, error) {
+	uwb := make(map[string]interface{})
+
+	err := protoFields(b, func(field protoField) error {
+		switch field.number {
+		case 1, 2, 5, 6:
+			if field.typ != protowire.Fixed64Type {
+				return fmt.Errorf("field %d has wire type %d", field.number, field.typ)
+			}
+			name := map[protowire.Number]string{1: "distance", 2: "quality", 5: "first_path", 6: "rx_power"}[field.number]
+			uwb[name] = math.Float64frombits(field.fixed)
+		case 3:
+			if field.typ != protowire.BytesType {
+				return fmt.Errorf("field target_id has wire type %d", field.typ)
+			}
+			uwb["target_id"] = string(field.bytes)
+		case 4:
+			if field.typ != protowire.VarintType {
+				return fmt.Errorf("field rssi has wire type %d", field.typ)
+			}
+			uwb["rssi"] = protowire.DecodeZigZag(field.varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// proto3 omits zero values, but distance is required by the JSON schema.
+	if _, exists := uwb["distance"]; !exists {
+		uwb["distance"] = 0.0
+	}
+
+	return uwb, nil
+}
+
+func protoFields(b []byte, handle func(field protoField) error) error {
+	for len(b) > 0 {
+		number, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		field := protoField{number: number, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			field.fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var fixed uint32
+			fixed, n = protowire.ConsumeFixed32(b)
+			field.fixed = uint64(fixed)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(number, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := handle(field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
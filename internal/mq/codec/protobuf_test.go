@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"encoding/json"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func protoString(b []byte, number protowire.Number, value string) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+func protoMessage(b []byte, number protowire.Number, message []byte) []byte {
+	b = protowire.AppendTag(b, number, protowire.BytesType)
+	return protowire.AppendBytes(b, message)
+}
+
+func protoDouble(b []byte, number protowire.Number, value float64) []byte {
+	b = protowire.AppendTag(b, number, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(value))
+}
+
+func protoVarint(b []byte, number protowire.Number, value uint64) []byte {
+	b = protowire.AppendTag(b, number, protowire.VarintType)
+	return protowire.AppendVarint(b, value)
+}
+
+func protoBatch(measurements ...[]byte) []byte {
+	var batch []byte
+	for _, measurement := range measurements {
+		batch = protoMessage(batch, 1, measurement)
+	}
+	return batch
+}
+
+func TestTranscodeProtobuf(t *testing.T) {
+	uwb := protoDouble(nil, 1, 2.5)
+	uwb = protoDouble(uwb, 2, 0.9)
+	uwb = protoString(uwb, 3, "b2")
+	uwb = protoVarint(uwb, 4, protowire.EncodeZigZag(-70))
+	uwb = protoDouble(uwb, 5, 1.25)
+	uwb = protoDouble(uwb, 6, -80.5)
+
+	uwbMeasurement := protoString(nil, 1, "m1")
+	uwbMeasurement = protoString(uwbMeasurement, 2, "a1")
+	uwbMeasurement = protoString(uwbMeasurement, 3, "uwb")
+	uwbMeasurement = protoMessage(uwbMeasurement, 4, uwb)
+	uwbMeasurement = protoString(uwbMeasurement, 7, "m")
+	uwbMeasurement = protoVarint(uwbMeasurement, 8, 1767323045000)
+	uwbMeasurement = protoMessage(uwbMeasurement, 9, protoString(protoString(nil, 1, "firmware"), 2, "1.2.0"))
+
+	numberMeasurement := protoString(nil, 3, "temperature")
+	numberMeasurement = protoDouble(numberMeasurement, 5, 21.5)
+	numberMeasurement = protoString(numberMeasurement, 7, "C")
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "empty batch",
+			payload: nil,
+			want:    `{"measurements":[]}`,
+		},
+		{
+			name:    "uwb measurement",
+			payload: protoBatch(uwbMeasurement),
+			want: `{"measurements":[{
+				"id":"m1","station_id":"a1","type":"uwb","unit":"m",
+				"value":{"distance":2.5,"quality":0.9,"target_id":"b2","rssi":-70,"first_path":1.25,"rx_power":-80.5},
+				"timestamp":"2026-01-02T03:04:05Z",
+				"metadata":{"firmware":"1.2.0"}
+			}]}`,
+		},
+		{
+			name:    "several measurements keep their order",
+			payload: protoBatch(numberMeasurement, protoString(nil, 6, "on")),
+			want:    `{"measurements":[{"type":"temperature","value":21.5,"unit":"C"},{"value":"on"}]}`,
+		},
+		{
+			name:    "uwb distance defaults to zero",
+			payload: protoBatch(protoMessage(nil, 4, protoString(nil, 3, "b2"))),
+			want:    `{"measurements":[{"value":{"distance":0,"target_id":"b2"}}]}`,
+		},
+		{
+			name:    "zero timestamp is omitted",
+			payload: protoBatch(protoVarint(protoString(nil, 1, "m1"), 8, 0)),
+			want:    `{"measurements":[{"id":"m1"}]}`,
+		},
+		{
+			name:    "unknown fields are skipped",
+			payload: protoVarint(protoBatch(protoVarint(protoString(nil, 1, "m1"), 15, 7)), 2, 1),
+			want:    `{"measurements":[{"id":"m1"}]}`,
+		},
+		{
+			name:    "wrong wire type of measurements",
+			payload: protoVarint(nil, 1, 1),
+			wantErr: true,
+		},
+		{
+			name:    "wrong wire type of a field",
+			payload: protoBatch(protoVarint(nil, 2, 1)),
+			wantErr: true,
+		},
+		{
+			name:    "truncated payload",
+			payload: protoBatch(uwbMeasurement)[:10],
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := transcodeProtobuf(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transcodeProtobuf error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var gotValue, wantValue interface{}
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatalf("transcodeProtobuf returned invalid JSON %s: %v", got, err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatalf("invalid expected JSON: %v", err)
+			}
+			if !reflect.DeepEqual(gotValue, wantValue) {
+				t.Errorf("transcodeProtobuf = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const EncodingJSON = "json"
+
+// Decoder transcodes a payload in its encoding to the JSON representation the
+// handlers validate and unmarshal.
+type Decoder interface {
+	Transcode(payload []byte) ([]byte, error)
+}
+
+type DecoderFunc func(payload []byte) ([]byte, error)
+
+func (f DecoderFunc) Transcode(payload []byte) ([]byte, error) {
+	return f(payload)
+}
+
+// Registry maps encoding names (used as topic suffix) and MQTT 5 content types
+// to decoders.
+type Registry struct {
+	mu           sync.RWMutex
+	decoders     map[string]Decoder
+	contentTypes map[string]string
+}
+
+// NewRegistry returns a registry with JSON, CBOR, MessagePack and Protobuf
+// decoders registered.
+func NewRegistry() *Registry {
+	registry := &Registry{
+		decoders:     make(map[string]Decoder),
+		contentTypes: make(map[string]string),
+	}
+
+	registry.Register(EncodingJSON, DecoderFunc(transcodeJSON), "application/json", "text/json")
+	registry.Register(EncodingCBOR, DecoderFunc(transcodeCBOR), "application/cbor")
+	registry.Register(EncodingMsgPack, DecoderFunc(transcodeMsgPack), "application/msgpack", "application/x-msgpack", "application/vnd.msgpack")
+	registry.Register(EncodingProtobuf, DecoderFunc(transcodeProtobuf), "application/protobuf", "application/x-protobuf")
+
+	return registry
+}
+
+func (r *Registry) Register(name string, decoder Decoder, contentTypes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.decoders[name] = decoder
+	for _, contentType := range contentTypes {
+		r.contentTypes[strings.ToLower(contentType)] = name
+	}
+}
+
+// Encodings returns the names of all registered encodings except JSON, which
+// is published without a topic suffix.
+func (r *Registry) Encodings() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	encodings := make([]string, 0, len(r.decoders))
+	for name := range r.decoders {
+		if name != EncodingJSON {
+			encodings = append(encodings, name)
+		}
+	}
+	sort.Strings(encodings)
+	return encodings
+}
+
+func (r *Registry) ByName(name string) (Decoder, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	decoder, exists := r.decoders[strings.ToLower(name)]
+	if !exists {
+		return nil, fmt.Errorf("unknown encoding %q", name)
+	}
+	return decoder, nil
+}
+
+// EncodingOf returns the name of the encoding registered for contentType.
+func (r *Registry) EncodingOf(contentType string) (string, error) {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name, exists := r.contentTypes[mediaType]
+	if !exists {
+		return "", fmt.Errorf("unsupported content type %q", contentType)
+	}
+	return name, nil
+}
+
+func transcodeJSON(payload []byte) ([]byte, error) {
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("payload is not valid JSON")
+	}
+	return payload, nil
+}
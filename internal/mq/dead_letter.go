@@ -0,0 +1,245 @@
+package mq
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq/schemas"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	DeadLetterTopicTemplate  = "%s/v1/dlq/%s/%s/%s"
+	DeadLetterFilterTemplate = "%s/v1/dlq/%s/+/+"
+
+	PayloadEncodingUTF8   = "utf-8"
+	PayloadEncodingBase64 = "base64"
+
+	// deadLetterCollectWindow is how long a replay waits for further retained
+	// entries after the last one arrived.
+	deadLetterCollectWindow = 2 * time.Second
+)
+
+// DeadLetter is a rejected inbound message together with the reason it was
+// rejected.
+type DeadLetter struct {
+	Topic           string            `json:"topic"`
+	Payload         string            `json:"payload"`
+	PayloadEncoding string            `json:"payload_encoding"`
+	Qos             byte              `json:"qos"`
+	Retained        bool              `json:"retained"`
+	ContentType     string            `json:"content_type,omitempty"`
+	UserProperties  map[string]string `json:"user_properties,omitempty"`
+	ErrorClass      string            `json:"error_class"`
+	Error           string            `json:"error"`
+	ReceivedAt      time.Time         `json:"received_at"`
+	InstanceID      string            `json:"instance_id"`
+}
+
+func NewDeadLetter(msg mqtt.Message, errorClass string, reason error, instanceID string) DeadLetter {
+	deadLetter := DeadLetter{
+		Topic:           msg.Topic(),
+		Payload:         string(msg.Payload()),
+		PayloadEncoding: PayloadEncodingUTF8,
+		Qos:             msg.Qos(),
+		Retained:        msg.Retained(),
+		ErrorClass:      errorClass,
+		ReceivedAt:      ReceivedAt(msg).UTC(),
+		InstanceID:      instanceID,
+	}
+
+	if reason != nil {
+		deadLetter.Error = reason.Error()
+	}
+
+	if !utf8.Valid(msg.Payload()) {
+		deadLetter.Payload = base64.StdEncoding.EncodeToString(msg.Payload())
+		deadLetter.PayloadEncoding = PayloadEncodingBase64
+	}
+
+	if properties := PropertiesOf(msg); properties != nil {
+		deadLetter.ContentType = properties.ContentType
+		deadLetter.UserProperties = properties.UserProperties
+	}
+
+	return deadLetter
+}
+
+// RawPayload returns the payload exactly as it was originally received.
+func (d DeadLetter) RawPayload() ([]byte, error) {
+	if d.PayloadEncoding == PayloadEncodingBase64 {
+		return base64.StdEncoding.DecodeString(d.Payload)
+	}
+	return []byte(d.Payload), nil
+}
+
+// DeadLetterQueue publishes rejected messages as retained entries to
+// {base}/v1/dlq/{family}/{id}/{entry}, so every rejection stays available
+// until it is replayed.
+type DeadLetterQueue struct {
+	client    *Client
+	baseTopic string
+	logger    zerolog.Logger
+}
+
+func NewDeadLetterQueue(client *Client, topicManager *TopicManager, logger zerolog.Logger) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		client:    client,
+		baseTopic: topicManager.GetBaseTopic(),
+		logger:    logger,
+	}
+}
+
+// topic returns the topic of a new entry for a message rejected on
+// originalTopic. The entry id starts with the receive time, so the entries of
+// a station list in the order they were rejected.
+func (q *DeadLetterQueue) topic(originalTopic string, receivedAt time.Time) string {
+	family, id := TopicFamily(originalTopic), TopicID(originalTopic)
+	if family == "" {
+		family = "unknown"
+	}
+	if id == "" {
+		id = "unknown"
+	}
+	entry := fmt.Sprintf("%d-%s", receivedAt.UnixNano(), uuid.NewString()[:8])
+	return fmt.Sprintf(DeadLetterTopicTemplate, q.baseTopic, family, id, entry)
+}
+
+func (q *DeadLetterQueue) Publish(msg mqtt.Message, errorClass string, reason error) error {
+	deadLetter := NewDeadLetter(msg, errorClass, reason, q.client.InstanceID())
+	topic := q.topic(msg.Topic(), deadLetter.ReceivedAt)
+
+	options := DefaultMessageOptions()
+	options.Qos = 1
+
+	if err := q.client.PublishJsonWithOptions(topic, deadLetter, options); err != nil {
+		return fmt.Errorf("failed to publish dead letter to %s: %w", topic, err)
+	}
+
+	q.logger.Warn().
+		Str("topic", msg.Topic()).
+		Str("dlq_topic", topic).
+		Str("error_class", errorClass).
+		Msg("Published rejected message to dead-letter queue")
+
+	return nil
+}
+
+// Replay re-publishes all dead letters of family (or of every family when
+// family is empty) to their original topics, in the order they were received,
+// and clears the entries.
+func (q *DeadLetterQueue) Replay(ctx context.Context, family string) (int, error) {
+	if family == "" {
+		family = "+"
+	}
+	filter := fmt.Sprintf(DeadLetterFilterTemplate, q.baseTopic, family)
+
+	var mu sync.Mutex
+	entries := make(map[string]DeadLetter)
+	arrived := make(chan struct{}, 1)
+
+	err := q.client.Subscribe(filter, 1, func(client mqtt.Client, msg mqtt.Message) {
+		if len(msg.Payload()) == 0 {
+			return
+		}
+
+		var deadLetter DeadLetter
+		if _, err := DecodeMessage(msg, &deadLetter); err != nil {
+			q.logger.Error().Err(err).
+				Str("topic", msg.Topic()).
+				Msg("Skipping unreadable dead letter")
+			return
+		}
+
+		mu.Lock()
+		entries[msg.Topic()] = deadLetter
+		mu.Unlock()
+
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to subscribe to %s: %w", filter, err)
+	}
+	defer func() {
+		_ = q.client.Unsubscribe(filter)
+	}()
+
+	// Retained entries are delivered right after subscribing, so collect until
+	// the broker stays quiet for a moment.
+	timer := time.NewTimer(deadLetterCollectWindow)
+	defer timer.Stop()
+collect:
+	for {
+		select {
+		case <-arrived:
+			timer.Reset(deadLetterCollectWindow)
+		case <-timer.C:
+			break collect
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	topics := make([]string, 0, len(entries))
+	for topic := range entries {
+		topics = append(topics, topic)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return entries[topics[i]].ReceivedAt.Before(entries[topics[j]].ReceivedAt)
+	})
+
+	replayed := 0
+	for _, topic := range topics {
+		deadLetter := entries[topic]
+		if err := q.replay(deadLetter); err != nil {
+			return replayed, fmt.Errorf("failed to replay %s: %w", topic, err)
+		}
+
+		clearOptions := DefaultMessageOptions()
+		clearOptions.Qos = 1
+		if err := q.client.PublishWithOptions(topic, nil, clearOptions); err != nil {
+			return replayed, fmt.Errorf("failed to clear %s: %w", topic, err)
+		}
+
+		q.logger.Info().
+			Str("topic", deadLetter.Topic).
+			Str("error_class", deadLetter.ErrorClass).
+			Time("received_at", deadLetter.ReceivedAt).
+			Msg("Replayed dead letter")
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+func (q *DeadLetterQueue) replay(deadLetter DeadLetter) error {
+	payload, err := deadLetter.RawPayload()
+	if err != nil {
+		return fmt.Errorf("invalid payload: %w", err)
+	}
+
+	// Replayed measurements expire like live ones, so consumers that are offline
+	// do not receive a backlog of stale positions.
+	options := DefaultMessageOptions()
+	if TopicFamily(deadLetter.Topic) == schemas.FamilyMeasurements {
+		options = q.client.MeasurementMessageOptions()
+	}
+	options.Qos = deadLetter.Qos
+	options.Retained = deadLetter.Retained
+	options.ContentType = deadLetter.ContentType
+	options.UserProperties = deadLetter.UserProperties
+
+	return q.client.PublishWithOptions(deadLetter.Topic, payload, options)
+}
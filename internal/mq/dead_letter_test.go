@@ -0,0 +1,39 @@
+package mq
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterQueueTopic(t *testing.T) {
+	q := &DeadLetterQueue{baseTopic: "gps-no"}
+	receivedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		topic      string
+		wantPrefix string
+	}{
+		{name: "station", topic: "gps-no/v1/stations/a1", wantPrefix: "gps-no/v1/dlq/stations/a1/"},
+		{name: "encoded measurement", topic: "gps-no/v1/measurements/a1/cbor", wantPrefix: "gps-no/v1/dlq/measurements/a1/"},
+		{name: "unknown family", topic: "other", wantPrefix: "gps-no/v1/dlq/unknown/unknown/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := q.topic(tt.topic, receivedAt)
+			second := q.topic(tt.topic, receivedAt)
+
+			for _, topic := range []string{first, second} {
+				entry, found := strings.CutPrefix(topic, tt.wantPrefix)
+				if !found || entry == "" || strings.Contains(entry, "/") {
+					t.Errorf("topic %s is not an entry below %s", topic, tt.wantPrefix)
+				}
+			}
+			if first == second {
+				t.Errorf("two rejections share the topic %s", first)
+			}
+		})
+	}
+}
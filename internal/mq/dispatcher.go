@@ -0,0 +1,261 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/config/components"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const (
+	OverflowBlock      = "block"
+	OverflowDropOldest = "drop-oldest"
+	OverflowDeadLetter = "dead-letter"
+)
+
+var (
+	ErrQueueFull         = errors.New("processing queue is full")
+	ErrDispatcherStopped = errors.New("dispatcher is stopped")
+)
+
+// DeadLetterSink receives messages the dispatcher could not hand to a worker.
+type DeadLetterSink func(family string, msg mqtt.Message, reason error)
+
+type dispatchJob struct {
+	client mqtt.Client
+	msg    mqtt.Message
+}
+
+// receivedMessage remembers when a message arrived, before it waited in a queue.
+type receivedMessage struct {
+	mqtt.Message
+	receivedAt time.Time
+}
+
+func (m *receivedMessage) Properties() *Properties {
+	return PropertiesOf(m.Message)
+}
+
+// ReceivedAt returns the time msg was received from the broker.
+func ReceivedAt(msg mqtt.Message) time.Time {
+	if received, ok := msg.(*receivedMessage); ok {
+		return received.receivedAt
+	}
+	return time.Now()
+}
+
+type familyQueue struct {
+	name    string
+	handler mqtt.MessageHandler
+	queues  []chan dispatchJob
+}
+
+// Dispatcher decouples message handlers from the MQTT client callbacks. Every
+// topic family gets its own set of bounded queues, each drained by a single
+// worker, and messages for the same id are always routed to the same queue so
+// they are processed in order.
+type Dispatcher struct {
+	workers    int
+	queueDepth int
+	overflow   string
+	logger     zerolog.Logger
+
+	mu         sync.RWMutex
+	families   map[string]*familyQueue
+	deadLetter DeadLetterSink
+	stopped    bool
+
+	wg sync.WaitGroup
+}
+
+func NewDispatcher(cfg *components.ServiceConfigImpl, logger zerolog.Logger) *Dispatcher {
+	d := &Dispatcher{
+		workers:    cfg.MaxConcurrentProcessing,
+		queueDepth: cfg.ProcessingQueueDepth,
+		overflow:   cfg.ProcessingOverflow,
+		logger:     logger,
+		families:   make(map[string]*familyQueue),
+	}
+
+	d.deadLetter = func(family string, msg mqtt.Message, reason error) {
+		d.logger.Warn().Err(reason).
+			Str("family", family).
+			Str("topic", msg.Topic()).
+			Msg("Dead-lettered message")
+	}
+
+	return d
+}
+
+// SetDeadLetterSink replaces the sink used by the dead-letter overflow policy.
+func (d *Dispatcher) SetDeadLetterSink(sink DeadLetterSink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deadLetter = sink
+}
+
+// Handle returns a message handler for the subscription filter topic that
+// queues messages for handler instead of running it on the client goroutine.
+// Every filter gets its own workers, so e.g. command acks never wait behind
+// station updates of the same family.
+func (d *Dispatcher) Handle(topic string, handler mqtt.MessageHandler) mqtt.MessageHandler {
+	family := TopicFamily(topic)
+	if family == "" {
+		family = topic
+	}
+
+	d.mu.Lock()
+	queue, exists := d.families[topic]
+	if !exists {
+		queue = d.startFamily(topic, family, handler)
+		d.families[topic] = queue
+	}
+	d.mu.Unlock()
+
+	return func(client mqtt.Client, msg mqtt.Message) {
+		msg = &receivedMessage{Message: msg, receivedAt: time.Now()}
+		if err := d.dispatch(queue, dispatchJob{client: client, msg: msg}); err != nil {
+			d.logger.Warn().Err(err).
+				Str("family", family).
+				Str("topic", msg.Topic()).
+				Msg("Failed to dispatch message")
+		}
+	}
+}
+
+func (d *Dispatcher) startFamily(topic, family string, handler mqtt.MessageHandler) *familyQueue {
+	queue := &familyQueue{
+		name:    family,
+		handler: handler,
+		queues:  make([]chan dispatchJob, d.workers),
+	}
+
+	for i := range queue.queues {
+		queue.queues[i] = make(chan dispatchJob, d.queueDepth)
+
+		d.wg.Add(1)
+		go d.work(queue, queue.queues[i])
+	}
+
+	d.logger.Info().
+		Str("family", family).
+		Str("topic", topic).
+		Int("workers", d.workers).
+		Int("queue_depth", d.queueDepth).
+		Str("overflow", d.overflow).
+		Msg("Started message workers")
+
+	return queue
+}
+
+func (d *Dispatcher) work(family *familyQueue, jobs <-chan dispatchJob) {
+	defer d.wg.Done()
+
+	for job := range jobs {
+		d.process(family, job)
+	}
+}
+
+func (d *Dispatcher) process(family *familyQueue, job dispatchJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.logger.Error().
+				Str("family", family.name).
+				Str("topic", job.msg.Topic()).
+				Interface("panic", r).
+				Msg("Message handler panicked")
+		}
+	}()
+
+	family.handler(job.client, job.msg)
+}
+
+func (d *Dispatcher) dispatch(family *familyQueue, job dispatchJob) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.stopped {
+		return ErrDispatcherStopped
+	}
+
+	queue := family.queues[d.partition(job.msg.Topic())]
+
+	switch d.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- job:
+				return nil
+			default:
+			}
+
+			select {
+			case dropped := <-queue:
+				d.logger.Warn().
+					Str("family", family.name).
+					Str("topic", dropped.msg.Topic()).
+					Msg("Processing queue full, dropped oldest message")
+			default:
+			}
+		}
+	case OverflowDeadLetter:
+		select {
+		case queue <- job:
+		default:
+			d.deadLetter(family.name, job.msg, ErrQueueFull)
+		}
+		return nil
+	default:
+		queue <- job
+		return nil
+	}
+}
+
+// partition keeps all messages of one station (or cluster) on the same worker.
+func (d *Dispatcher) partition(topic string) int {
+	key := TopicID(topic)
+	if key == "" {
+		key = topic
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(d.workers))
+}
+
+// Stop stops accepting messages and waits until the queued ones are processed
+// or ctx expires.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return nil
+	}
+	d.stopped = true
+	for _, family := range d.families {
+		for _, queue := range family.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		d.logger.Info().Msg("Dispatcher stopped")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for message workers: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,189 @@
+package mq
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/config/components"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 1 }
+func (m *testMessage) Retained() bool    { return m.retained }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func newTestDispatcher(workers, queueDepth int, overflow string) *Dispatcher {
+	return NewDispatcher(&components.ServiceConfigImpl{
+		MaxConcurrentProcessing: workers,
+		ProcessingQueueDepth:    queueDepth,
+		ProcessingOverflow:      overflow,
+	}, zerolog.Nop())
+}
+
+func TestDispatcherPartition(t *testing.T) {
+	tests := []struct {
+		name   string
+		topics []string
+	}{
+		{
+			name:   "station document and subtopics",
+			topics: []string{"gps-no/v1/stations/a1", "gps-no/v1/stations/a1/patch", "gps-no/v1/stations/a1/heartbeat"},
+		},
+		{
+			name:   "measurement encodings",
+			topics: []string{"gps-no/v1/measurements/a1", "gps-no/v1/measurements/a1/cbor"},
+		},
+		{
+			name:   "topic without id",
+			topics: []string{"other/topic", "other/topic"},
+		},
+	}
+
+	d := newTestDispatcher(8, 1, OverflowBlock)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := d.partition(tt.topics[0])
+			if want < 0 || want >= d.workers {
+				t.Fatalf("partition(%s) = %d, out of range", tt.topics[0], want)
+			}
+			for _, topic := range tt.topics[1:] {
+				if got := d.partition(topic); got != want {
+					t.Errorf("partition(%s) = %d, want %d", topic, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDispatcherPartitionSpreadsIDs(t *testing.T) {
+	d := newTestDispatcher(4, 1, OverflowBlock)
+
+	used := make(map[int]bool)
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+		used[d.partition("gps-no/v1/stations/"+id)] = true
+	}
+	if len(used) < 2 {
+		t.Errorf("12 ids used %d of 4 workers", len(used))
+	}
+}
+
+func TestDispatcherOverflow(t *testing.T) {
+	tests := []struct {
+		name           string
+		overflow       string
+		wantQueued     []string
+		wantDeadLetter []string
+	}{
+		{
+			name:           "drop oldest keeps newest",
+			overflow:       OverflowDropOldest,
+			wantQueued:     []string{"3"},
+			wantDeadLetter: []string{},
+		},
+		{
+			name:           "dead letter keeps queued and rejects the rest",
+			overflow:       OverflowDeadLetter,
+			wantQueued:     []string{"1"},
+			wantDeadLetter: []string{"2", "3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestDispatcher(1, 1, tt.overflow)
+
+			deadLetters := []string{}
+			d.SetDeadLetterSink(func(family string, msg mqtt.Message, reason error) {
+				if reason != ErrQueueFull {
+					t.Errorf("dead letter reason = %v, want %v", reason, ErrQueueFull)
+				}
+				deadLetters = append(deadLetters, string(msg.Payload()))
+			})
+
+			// No workers are started, so the queue only fills up.
+			family := &familyQueue{name: "stations", queues: []chan dispatchJob{make(chan dispatchJob, 1)}}
+			for _, payload := range []string{"1", "2", "3"} {
+				msg := &testMessage{topic: "gps-no/v1/stations/a1", payload: []byte(payload)}
+				if err := d.dispatch(family, dispatchJob{msg: msg}); err != nil {
+					t.Fatalf("dispatch(%s) failed: %v", payload, err)
+				}
+			}
+
+			queued := []string{}
+			for len(family.queues[0]) > 0 {
+				queued = append(queued, string((<-family.queues[0]).msg.Payload()))
+			}
+
+			if !reflect.DeepEqual(queued, tt.wantQueued) {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+			if !reflect.DeepEqual(deadLetters, tt.wantDeadLetter) {
+				t.Errorf("dead letters = %v, want %v", deadLetters, tt.wantDeadLetter)
+			}
+		})
+	}
+}
+
+func TestDispatcherOverflowBlock(t *testing.T) {
+	d := newTestDispatcher(1, 1, OverflowBlock)
+	family := &familyQueue{name: "stations", queues: []chan dispatchJob{make(chan dispatchJob, 1)}}
+	msg := &testMessage{topic: "gps-no/v1/stations/a1"}
+
+	if err := d.dispatch(family, dispatchJob{msg: msg}); err != nil {
+		t.Fatalf("dispatch failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.dispatch(family, dispatchJob{msg: msg})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("dispatch to a full queue returned instead of blocking")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-family.queues[0]
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("blocked dispatch failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dispatch did not resume after the queue was drained")
+	}
+}
+
+func TestDispatcherStop(t *testing.T) {
+	d := newTestDispatcher(2, 4, OverflowBlock)
+
+	processed := make(chan string, 4)
+	handler := d.Handle("gps-no/v1/stations/+", func(client mqtt.Client, msg mqtt.Message) {
+		processed <- string(msg.Payload())
+	})
+	handler(nil, &testMessage{topic: "gps-no/v1/stations/a1", payload: []byte("1")})
+
+	if err := d.Stop(t.Context()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if got := <-processed; got != "1" {
+		t.Errorf("processed %s, want 1", got)
+	}
+
+	err := d.dispatch(d.families["gps-no/v1/stations/+"], dispatchJob{msg: &testMessage{topic: "gps-no/v1/stations/a1"}})
+	if err != ErrDispatcherStopped {
+		t.Errorf("dispatch after stop = %v, want %v", err, ErrDispatcherStopped)
+	}
+}
@@ -2,14 +2,13 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog"
 	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/mq/schemas"
 	"gps-no-sync/internal/services"
-	"time"
 )
 
 type ClusterHandler struct {
@@ -17,18 +16,30 @@ type ClusterHandler struct {
 	logger         zerolog.Logger
 	handlerTopic   string
 	topicManager   *mq.TopicManager
+	payloads       *PayloadValidator
+	deadLetters    *mq.DeadLetterQueue
+	repairs        *RepairLimiter
+	replies        *Replier
 }
 
 func NewClusterHandler(
 	clusterService *services.ClusterService,
 	logger zerolog.Logger,
 	topicManager *mq.TopicManager,
+	payloads *PayloadValidator,
+	deadLetters *mq.DeadLetterQueue,
+	repairs *RepairLimiter,
+	replies *Replier,
 ) *ClusterHandler {
 	return &ClusterHandler{
 		clusterService: clusterService,
 		logger:         logger,
 		handlerTopic:   topicManager.GetClusterTopic(),
 		topicManager:   topicManager,
+		payloads:       payloads,
+		deadLetters:    deadLetters,
+		repairs:        repairs,
+		replies:        replies,
 	}
 }
 
@@ -45,25 +56,70 @@ func (c *ClusterHandler) TransformMessage(ctx context.Context, msg mqtt.Message)
 	}
 
 	var clusterMessage mq.ClusterMessage
-	if err := json.Unmarshal(msg.Payload(), &clusterMessage); err != nil {
-		err := c.clusterService.SyncAll(ctx)
-		if err != nil {
-			c.logger.Error().Err(err).
-				Str("topic", topic).
-				Msg("Failed to sync all clusters after invalid message")
-			return nil, fmt.Errorf("failed to sync clusters: %w", err)
-		}
-		return nil, fmt.Errorf("could not parse cluster data: %w", ErrInvalidMessage)
+	provenance, err := c.payloads.Decode(schemas.FamilyClusters, msg, &clusterMessage.Data)
+	if err != nil {
+		c.repair(ctx, topic)
+		return nil, fmt.Errorf("could not parse cluster data: %w", err)
+	}
+	clusterMessage.Provenance = provenance
+	clusterMessage.HasCredential = mq.Authorization(msg) != ""
+	clusterMessage.Topic, err = c.topicManager.ExtractClusterId(topic)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	return &clusterMessage, nil
+}
+
+// TransformRequest decodes a membership change published on the cluster request
+// topic.
+func (c *ClusterHandler) TransformRequest(msg mqtt.Message) (*mq.ClusterMessage, error) {
+	if msg == nil {
+		return nil, fmt.Errorf("received nil message: %w", ErrMessageIsNil)
+	}
+
+	if len(msg.Payload()) == 0 {
+		return nil, ErrEmptyMessage
+	}
+
+	topicID, err := c.topicManager.ExtractClusterRequestId(msg.Topic())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	var clusterMessage mq.ClusterMessage
+	provenance, err := c.payloads.Decode(schemas.FamilyClusters, msg, &clusterMessage.Data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse cluster request: %w", err)
 	}
-	clusterMessage.Topic = c.topicManager.ExtractClusterId(topic)
+	clusterMessage.Provenance = provenance
+	clusterMessage.Topic = topicID
 
 	return &clusterMessage, nil
 }
 
-func (c *ClusterHandler) HandleMessage(client mqtt.Client, msg mqtt.Message) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// repair restores the retained state of the cluster a malformed message was
+// published for.
+func (c *ClusterHandler) repair(ctx context.Context, topic string) {
+	if c.repairs != nil && !c.repairs.Allow(topic) {
+		c.logger.Debug().Str("topic", topic).Msg("Skipping cluster repair, repaired recently")
+		return
+	}
 
+	topicID, err := c.topicManager.ExtractClusterId(topic)
+	if err != nil {
+		c.logger.Warn().Err(err).Msg("Cannot repair cluster of unexpected topic")
+		return
+	}
+
+	if err := c.clusterService.Repair(ctx, topicID); err != nil {
+		c.logger.Error().Err(err).
+			Str("topic", topic).
+			Msg("Failed to repair cluster after invalid message")
+	}
+}
+
+func (c *ClusterHandler) HandleMessage(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
 
 	clusterMessage, err := c.TransformMessage(ctx, msg)
@@ -76,9 +132,61 @@ func (c *ClusterHandler) HandleMessage(client mqtt.Client, msg mqtt.Message) {
 			Str("message", string(msg.Payload())).
 			Str("topic", topic).
 			Msg("Failed to transform message")
+		deadLetter(c.deadLetters, c.logger, msg, err)
 		return
 	}
 
-	c.clusterService.ProcessMessage(ctx, clusterMessage)
+	report, err := c.clusterService.ProcessMessage(ctx, clusterMessage)
+	c.answer(msg, clusterMessage.Topic, report, err)
+}
+
+// HandleRequest handles a membership change published on the cluster request
+// topic. The broker only lets the commissioning client publish there, so the
+// request needs no credential. Retained requests are ignored, as every new
+// leader would apply them again.
+func (c *ClusterHandler) HandleRequest(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
 
+	if msg.Retained() {
+		c.logger.Warn().
+			Str("topic", topic).
+			Msg("Ignoring retained cluster request")
+		return
+	}
+
+	clusterMessage, err := c.TransformRequest(msg)
+	if err != nil {
+		if errors.Is(err, ErrEmptyMessage) {
+			return
+		}
+
+		c.logger.Error().Err(err).
+			Str("topic", topic).
+			Msg("Failed to transform cluster request")
+		deadLetter(c.deadLetters, c.logger, msg, err)
+		return
+	}
+
+	report, err := c.clusterService.ProcessRequest(ctx, clusterMessage)
+	c.answer(msg, clusterMessage.Topic, report, err)
+}
+
+// answer replies to msg with the outcome of processing it for the cluster on
+// topic id.
+func (c *ClusterHandler) answer(msg mqtt.Message, topicID string, report *services.MembershipReport, err error) {
+	var conflict *services.ClusterConflictError
+	if errors.As(err, &conflict) {
+		c.replies.Reply(msg, c.topicManager.GetConflictTopic(schemas.FamilyClusters, topicID), conflict.Conflict)
+		return
+	}
+
+	if err != nil {
+		c.logger.Error().Err(err).
+			Str("topic", msg.Topic()).
+			Msg("Failed to process cluster message")
+	}
+
+	if report != nil {
+		c.replies.Reply(msg, c.topicManager.GetReportTopic(schemas.FamilyClusters, topicID), report)
+	}
 }
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq"
+	"testing"
+)
+
+type testMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 1 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 0 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              {}
+
+func newTestClusterHandler() *ClusterHandler {
+	return NewClusterHandler(nil, zerolog.Nop(), mq.NewTopicManager("gps-no", zerolog.Nop()), nil, nil, nil, nil)
+}
+
+func TestClusterHandlerTransformMessage(t *testing.T) {
+	tests := []struct {
+		name              string
+		payload           string
+		wantHasCredential bool
+	}{
+		{name: "document", payload: `{"data":{"name":"hall","stations":["aa:bb:cc:dd:ee:01"]}}`},
+		{name: "document with credential", payload: `{"data":{"name":"hall"},"authorization":"secret"}`, wantHasCredential: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &testMessage{topic: "gps-no/v1/clusters/7", payload: []byte(tt.payload)}
+
+			clusterMessage, err := newTestClusterHandler().TransformMessage(t.Context(), msg)
+			if err != nil {
+				t.Fatalf("TransformMessage failed: %v", err)
+			}
+			if clusterMessage.HasCredential != tt.wantHasCredential {
+				t.Errorf("HasCredential = %v, want %v", clusterMessage.HasCredential, tt.wantHasCredential)
+			}
+			if clusterMessage.Topic != "7" || clusterMessage.Data.Name != "hall" {
+				t.Errorf("cluster message = %+v, want cluster 7 named hall", clusterMessage)
+			}
+		})
+	}
+}
+
+func TestClusterHandlerTransformRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		topic     string
+		payload   string
+		wantTopic string
+		wantErr   error
+	}{
+		{name: "request", topic: "gps-no/v1/cluster-requests/7", payload: `{"data":{"name":"hall"}}`, wantTopic: "7"},
+		{name: "empty request", topic: "gps-no/v1/cluster-requests/7", wantErr: ErrEmptyMessage},
+		{name: "cluster topic", topic: "gps-no/v1/clusters/7", payload: `{"data":{"name":"hall"}}`, wantErr: ErrInvalidMessage},
+		{name: "malformed request", topic: "gps-no/v1/cluster-requests/7", payload: `{"data":`, wantErr: ErrInvalidMessage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &testMessage{topic: tt.topic, payload: []byte(tt.payload)}
+
+			clusterMessage, err := newTestClusterHandler().TransformRequest(msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("TransformRequest error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if clusterMessage.Topic != tt.wantTopic {
+				t.Errorf("topic = %s, want %s", clusterMessage.Topic, tt.wantTopic)
+			}
+		})
+	}
+}
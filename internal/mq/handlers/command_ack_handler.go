@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/services"
+)
+
+type CommandAckHandler struct {
+	commandService *services.CommandService
+	logger         zerolog.Logger
+	handlerTopic   string
+	deadLetters    *mq.DeadLetterQueue
+}
+
+func NewCommandAckHandler(
+	commandService *services.CommandService,
+	logger zerolog.Logger,
+	topicManager *mq.TopicManager,
+	deadLetters *mq.DeadLetterQueue,
+) *CommandAckHandler {
+	return &CommandAckHandler{
+		commandService: commandService,
+		logger:         logger,
+		handlerTopic:   topicManager.GetCommandAckTopic(),
+		deadLetters:    deadLetters,
+	}
+}
+
+func (h *CommandAckHandler) TransformMessage(ctx context.Context, msg mqtt.Message) (*mq.CommandAck, error) {
+	if msg == nil {
+		return nil, fmt.Errorf("received nil message: %w", ErrMessageIsNil)
+	}
+
+	if len(msg.Payload()) == 0 {
+		return nil, ErrEmptyMessage
+	}
+
+	data, _, err := mq.UnwrapMessage(msg)
+	if err != nil || len(data) == 0 {
+		// Stations may acknowledge with the bare ack object.
+		data = msg.Payload()
+	}
+
+	var ack mq.CommandAck
+	if err := json.Unmarshal(data, &ack); err != nil {
+		return nil, fmt.Errorf("could not parse command ack: %w: %v", ErrInvalidMessage, err)
+	}
+
+	if ack.ID == "" {
+		return nil, fmt.Errorf("command ack without id: %w", ErrValidationFailed)
+	}
+
+	return &ack, nil
+}
+
+func (h *CommandAckHandler) HandleMessage(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+
+	ack, err := h.TransformMessage(ctx, msg)
+	if err != nil {
+		if errors.Is(err, ErrEmptyMessage) {
+			return
+		}
+
+		h.logger.Error().Err(err).
+			Str("message", string(msg.Payload())).
+			Str("topic", topic).
+			Msg("Failed to transform command ack")
+		deadLetter(h.deadLetters, h.logger, msg, err)
+		return
+	}
+
+	if err := h.commandService.HandleAck(ctx, mq.TopicID(topic), ack); err != nil {
+		h.logger.Error().Err(err).
+			Str("topic", topic).
+			Str("command_id", ack.ID).
+			Msg("Failed to process command ack")
+	}
+}
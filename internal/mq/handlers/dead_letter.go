@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq"
+)
+
+var errorClasses = []struct {
+	err  error
+	name string
+}{
+	{ErrMessageIsNil, "ErrMessageIsNil"},
+	{ErrInvalidMessage, "ErrInvalidMessage"},
+	{ErrValidationFailed, "ErrValidationFailed"},
+	{ErrStationNotFound, "ErrStationNotFound"},
+	{mq.ErrQueueFull, "ErrQueueFull"},
+	{mq.ErrPayloadTooLarge, "ErrPayloadTooLarge"},
+	{mq.ErrHandlerPanic, "ErrHandlerPanic"},
+}
+
+// ErrorClass names the sentinel error that caused a message to be rejected.
+func ErrorClass(err error) string {
+	for _, class := range errorClasses {
+		if errors.Is(err, class.err) {
+			return class.name
+		}
+	}
+	return "ErrUnknown"
+}
+
+func deadLetter(queue *mq.DeadLetterQueue, logger zerolog.Logger, msg mqtt.Message, reason error) {
+	if queue == nil {
+		return
+	}
+
+	if err := queue.Publish(msg, ErrorClass(reason), reason); err != nil {
+		logger.Error().Err(err).
+			Str("topic", msg.Topic()).
+			Msg("Failed to publish rejected message to dead-letter queue")
+	}
+}
+
+// Rejecter returns a mq.RejectFunc that publishes messages refused by a
+// middleware to the dead-letter queue.
+func Rejecter(queue *mq.DeadLetterQueue, logger zerolog.Logger) mq.RejectFunc {
+	return func(msg mqtt.Message, reason error) {
+		logger.Warn().Err(reason).
+			Str("topic", msg.Topic()).
+			Msg("Rejected message")
+		deadLetter(queue, logger, msg, reason)
+	}
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"context"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/services"
+)
+
+// HeartbeatHandler marks stations as seen when they publish to their
+// heartbeat topic. The payload is not interpreted.
+type HeartbeatHandler struct {
+	livenessService *services.LivenessService
+	logger          zerolog.Logger
+}
+
+func NewHeartbeatHandler(livenessService *services.LivenessService, logger zerolog.Logger) *HeartbeatHandler {
+	return &HeartbeatHandler{
+		livenessService: livenessService,
+		logger:          logger,
+	}
+}
+
+func (h *HeartbeatHandler) HandleMessage(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+	// Retained heartbeats would mark stations online on every subscribe.
+	if msg.Retained() {
+		return
+	}
+
+	topic := msg.Topic()
+	if err := h.livenessService.Seen(ctx, mq.TopicID(topic), mq.ReceivedAt(msg)); err != nil {
+		h.logger.Error().Err(err).
+			Str("topic", topic).
+			Msg("Failed to process heartbeat")
+	}
+}
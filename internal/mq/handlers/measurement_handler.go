@@ -1,13 +1,17 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog"
+	"gps-no-sync/internal/models"
 	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/mq/codec"
+	"gps-no-sync/internal/mq/schemas"
 	"gps-no-sync/internal/services"
 	"time"
 )
@@ -17,70 +21,221 @@ type MeasurementHandler struct {
 	logger             zerolog.Logger
 	handlerTopic       string
 	topicManager       *mq.TopicManager
+	payloads           *PayloadValidator
+	deadLetters        *mq.DeadLetterQueue
+	decoders           *codec.Registry
 }
 
 func NewMeasurementHandler(
 	measurementService *services.MeasurementService,
 	logger zerolog.Logger,
 	topicManager *mq.TopicManager,
+	payloads *PayloadValidator,
+	deadLetters *mq.DeadLetterQueue,
+	decoders *codec.Registry,
 ) *MeasurementHandler {
 	return &MeasurementHandler{
 		measurementService: measurementService,
 		logger:             logger,
 		handlerTopic:       topicManager.GetMeasurementTopic(),
 		topicManager:       topicManager,
+		payloads:           payloads,
+		deadLetters:        deadLetters,
+		decoders:           decoders,
 	}
 }
 
-func (h *MeasurementHandler) TransformMessage(ctx context.Context, msg mqtt.Message) (*mq.MeasurementMessage, error) {
+// BatchReport tells a device which measurements of a batch were rejected.
+type BatchReport struct {
+	Topic      string          `json:"topic"`
+	Schema     string          `json:"schema"`
+	Total      int             `json:"total"`
+	Accepted   int             `json:"accepted"`
+	Rejected   []RejectedEntry `json:"rejected"`
+	ReceivedAt time.Time       `json:"received_at"`
+	InstanceID string          `json:"instance_id"`
+}
+
+type RejectedEntry struct {
+	Index  int                  `json:"index"`
+	Errors []schemas.FieldError `json:"errors"`
+}
+
+func (h *MeasurementHandler) TransformMessage(ctx context.Context, msg mqtt.Message) (*mq.MeasurementBatchMessage, error) {
 	if msg == nil {
 		return nil, fmt.Errorf("received nil message: %w", ErrMessageIsNil)
 	}
 
 	topic := msg.Topic()
-	payload := string(msg.Payload())
 
-	if len(payload) == 0 {
+	if len(msg.Payload()) == 0 {
 		return nil, ErrEmptyMessage
 	}
 
-	var measurementMessage mq.MeasurementMessage
-	if err := json.Unmarshal(msg.Payload(), &measurementMessage); err != nil {
+	data, provenance, err := h.decode(msg)
+	if err != nil {
+		h.logger.Error().Err(err).
+			Str("topic", topic).
+			Msg("Failed to decode measurement message")
+		return nil, fmt.Errorf("could not decode measurement data: %w: %v", ErrInvalidMessage, err)
+	}
+
+	items, err := splitBatch(data)
+	if err != nil {
 		h.logger.Error().Err(err).
 			Str("topic", topic).
-			Str("payload", payload).
+			Str("payload", string(data)).
 			Msg("Failed to parse measurement message")
-		return nil, fmt.Errorf("could not parse measurement data: %w", ErrInvalidMessage)
+		return nil, fmt.Errorf("could not parse measurement data: %w: %v", ErrInvalidMessage, err)
 	}
 
-	measurementMessage.Topic = topic
+	batchMessage := &mq.MeasurementBatchMessage{
+		Data:       make([]models.Measurement, 0, len(items)),
+		Provenance: provenance,
+		Topic:      topic,
+		ReceivedAt: mq.ReceivedAt(msg),
+	}
 
-	if measurementMessage.Data.StationID == "" {
-		stationID := h.topicManager.ExtractStationId(topic)
-		if stationID == "" {
-			h.logger.Error().
-				Str("topic", topic).
-				Msg("Could not extract station ID from topic")
-			return nil, fmt.Errorf("could not extract station ID from topic")
+	var rejected []RejectedEntry
+	for i, item := range items {
+		measurement, fieldErrors := h.transformItem(topic, item, batchMessage.ReceivedAt)
+		if len(fieldErrors) > 0 {
+			rejected = append(rejected, RejectedEntry{Index: i, Errors: fieldErrors})
+			continue
 		}
-		measurementMessage.Data.StationID = stationID
+		batchMessage.Data = append(batchMessage.Data, measurement)
 	}
 
-	// Set timestamp if not provided
-	if measurementMessage.Data.Timestamp.IsZero() {
-		measurementMessage.Data.Timestamp = time.Now()
+	if len(rejected) > 0 {
+		h.payloads.Report(schemas.FamilyMeasurements, msg, BatchReport{
+			Topic:      topic,
+			Schema:     schemas.Name(schemas.FamilyMeasurements),
+			Total:      len(items),
+			Accepted:   len(batchMessage.Data),
+			Rejected:   rejected,
+			ReceivedAt: mq.ReceivedAt(msg).UTC(),
+			InstanceID: h.payloads.InstanceID(),
+		})
+	}
+
+	if len(batchMessage.Data) == 0 {
+		return nil, fmt.Errorf("invalid measurement: %w: all %d measurements rejected", ErrValidationFailed, len(items))
+	}
+
+	return batchMessage, nil
+}
+
+// decode returns the measurement data of msg as JSON. The encoding is taken
+// from the topic suffix, then from the MQTT 5 content type, and defaults to
+// JSON.
+func (h *MeasurementHandler) decode(msg mqtt.Message) (json.RawMessage, mq.Provenance, error) {
+	encoding := mq.TopicSuffix(msg.Topic())
+	if encoding == "" {
+		encoding = codec.EncodingJSON
+		if properties := mq.PropertiesOf(msg); properties != nil && properties.ContentType != "" {
+			name, err := h.decoders.EncodingOf(properties.ContentType)
+			if err != nil {
+				return nil, mq.Provenance{}, err
+			}
+			encoding = name
+		}
+	}
+
+	if encoding == codec.EncodingJSON {
+		data, provenance, err := mq.UnwrapMessage(msg)
+		if err != nil || len(data) == 0 {
+			// Constrained devices may skip the envelope and publish the bare batch.
+			data, provenance = msg.Payload(), mq.Provenance{}
+		}
+		return data, provenance, nil
+	}
+
+	decoder, err := h.decoders.ByName(encoding)
+	if err != nil {
+		return nil, mq.Provenance{}, err
+	}
+
+	data, err := decoder.Transcode(msg.Payload())
+	if err != nil {
+		return nil, mq.Provenance{}, err
 	}
 
-	return &measurementMessage, nil
+	return data, mq.MessageProvenance(msg), nil
 }
 
-func (h *MeasurementHandler) HandleMessage(client mqtt.Client, msg mqtt.Message) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// splitBatch returns the items of a measurement payload, which is either a
+// single measurement, an array of measurements or {"measurements": [...]}.
+func splitBatch(data []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("empty measurement data")
+	}
+
+	if trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		if len(items) == 0 {
+			return nil, fmt.Errorf("empty measurement batch")
+		}
+		return items, nil
+	}
+
+	var batch struct {
+		Measurements []json.RawMessage `json:"measurements"`
+	}
+	if err := json.Unmarshal(trimmed, &batch); err != nil {
+		return nil, err
+	}
+	if batch.Measurements != nil {
+		if len(batch.Measurements) == 0 {
+			return nil, fmt.Errorf("empty measurement batch")
+		}
+		return batch.Measurements, nil
+	}
+
+	return []json.RawMessage{trimmed}, nil
+}
+
+func (h *MeasurementHandler) transformItem(topic string, item json.RawMessage, receivedAt time.Time) (models.Measurement, []schemas.FieldError) {
+	var measurement models.Measurement
+
+	if err := h.payloads.Check(schemas.FamilyMeasurements, item); err != nil {
+		var validationErr *schemas.ValidationError
+		if errors.As(err, &validationErr) {
+			return measurement, validationErr.Fields
+		}
+		return measurement, []schemas.FieldError{{Field: "/", Message: err.Error()}}
+	}
+
+	if err := json.Unmarshal(item, &measurement); err != nil {
+		return measurement, []schemas.FieldError{{Field: "/", Message: err.Error()}}
+	}
+
+	if measurement.StationID == "" {
+		measurement.StationID = h.topicManager.ExtractMeasurementStationId(topic)
+	}
+
+	// Set timestamp if not provided, device timestamps are corrected for clock
+	// offset by the measurement service
+	if measurement.Timestamp.IsZero() {
+		measurement.Timestamp = receivedAt
+	} else {
+		measurement.RawTimestamp = measurement.Timestamp
+	}
+
+	if err := measurement.Validate(); err != nil {
+		return measurement, []schemas.FieldError{{Field: "/", Message: err.Error()}}
+	}
+
+	return measurement, nil
+}
 
+func (h *MeasurementHandler) HandleMessage(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
 
-	measurementMessage, err := h.TransformMessage(ctx, msg)
+	batchMessage, err := h.TransformMessage(ctx, msg)
 	if err != nil {
 		if errors.Is(err, ErrEmptyMessage) {
 			return
@@ -90,21 +245,20 @@ func (h *MeasurementHandler) HandleMessage(client mqtt.Client, msg mqtt.Message)
 			Str("message", string(msg.Payload())).
 			Str("topic", topic).
 			Msg("Failed to transform measurement message")
+		deadLetter(h.deadLetters, h.logger, msg, err)
 		return
 	}
 
-	if err := h.measurementService.ProcessMessage(ctx, measurementMessage); err != nil {
+	if err := h.measurementService.ProcessBatch(ctx, batchMessage); err != nil {
 		h.logger.Error().Err(err).
 			Str("topic", topic).
-			Str("station_id", measurementMessage.Data.StationID).
-			Str("type", string(measurementMessage.Data.Type)).
+			Int("measurements", len(batchMessage.Data)).
 			Msg("Failed to process measurement message")
 		return
 	}
 
 	h.logger.Debug().
 		Str("topic", topic).
-		Str("station_id", measurementMessage.Data.StationID).
-		Str("type", string(measurementMessage.Data.Type)).
+		Int("measurements", len(batchMessage.Data)).
 		Msg("Measurement message processed successfully")
 }
@@ -0,0 +1,65 @@
+package handlers
+
+import "testing"
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "single measurement",
+			data: `{"type":"uwb","value":1}`,
+			want: []string{`{"type":"uwb","value":1}`},
+		},
+		{
+			name: "surrounding whitespace is trimmed",
+			data: " \n{\"value\":1}\n ",
+			want: []string{`{"value":1}`},
+		},
+		{
+			name: "array",
+			data: `[{"value":1}, {"value":2}]`,
+			want: []string{`{"value":1}`, `{"value":2}`},
+		},
+		{
+			name: "measurements object",
+			data: `{"measurements":[{"value":1},{"value":2}]}`,
+			want: []string{`{"value":1}`, `{"value":2}`},
+		},
+		{
+			name: "array items are kept as sent",
+			data: `[1, "a", null]`,
+			want: []string{`1`, `"a"`, `null`},
+		},
+		{name: "empty payload", data: "  ", wantErr: true},
+		{name: "empty array", data: `[]`, wantErr: true},
+		{name: "empty measurements", data: `{"measurements":[]}`, wantErr: true},
+		{name: "invalid json", data: `{"value":`, wantErr: true},
+		{name: "invalid array", data: `[{"value":1}`, wantErr: true},
+		{name: "scalar", data: `42`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := splitBatch([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitBatch(%s) error = %v, want error %v", tt.data, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(items) != len(tt.want) {
+				t.Fatalf("got %d items, want %d", len(items), len(tt.want))
+			}
+			for i, item := range items {
+				if string(item) != tt.want[i] {
+					t.Errorf("item %d = %s, want %s", i, item, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/mq/schemas"
+	"time"
+)
+
+// ErrorReport is published to {base}/v1/{family}/{id}/errors when a payload
+// does not match its schema.
+type ErrorReport struct {
+	Topic      string               `json:"topic"`
+	Schema     string               `json:"schema"`
+	Errors     []schemas.FieldError `json:"errors"`
+	ReceivedAt time.Time            `json:"received_at"`
+	InstanceID string               `json:"instance_id"`
+}
+
+// PayloadValidator checks inbound payloads against the embedded JSON Schemas
+// and reports violations back to the sending device.
+type PayloadValidator struct {
+	validator    *schemas.Validator
+	client       *mq.Client
+	topicManager *mq.TopicManager
+	logger       zerolog.Logger
+}
+
+func NewPayloadValidator(client *mq.Client, topicManager *mq.TopicManager, logger zerolog.Logger) (*PayloadValidator, error) {
+	validator, err := schemas.NewValidator()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payload schemas: %w", err)
+	}
+
+	return &PayloadValidator{
+		validator:    validator,
+		client:       client,
+		topicManager: topicManager,
+		logger:       logger,
+	}, nil
+}
+
+// Decode unwraps msg, validates its data against the schema of family and
+// unmarshals it into target.
+func (v *PayloadValidator) Decode(family string, msg mqtt.Message, target interface{}) (mq.Provenance, error) {
+	data, provenance, err := mq.UnwrapMessage(msg)
+	if err != nil {
+		return mq.Provenance{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	if err := v.Validate(family, msg, data); err != nil {
+		return mq.Provenance{}, err
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		return mq.Provenance{}, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	return provenance, nil
+}
+
+func (v *PayloadValidator) Validate(family string, msg mqtt.Message, data []byte) error {
+	err := v.Check(family, data)
+	if err == nil {
+		return nil
+	}
+
+	var validationErr *schemas.ValidationError
+	if errors.As(err, &validationErr) {
+		v.Report(family, msg, ErrorReport{
+			Topic:      msg.Topic(),
+			Schema:     validationErr.Schema,
+			Errors:     validationErr.Fields,
+			ReceivedAt: mq.ReceivedAt(msg).UTC(),
+			InstanceID: v.client.InstanceID(),
+		})
+	}
+
+	return fmt.Errorf("%w: %v", ErrValidationFailed, err)
+}
+
+// Check validates data against the schema of family without reporting back to
+// the device.
+func (v *PayloadValidator) Check(family string, data []byte) error {
+	if v == nil {
+		return nil
+	}
+	return v.validator.Validate(family, data)
+}
+
+// Report publishes report to the error topic of the device msg was sent by.
+func (v *PayloadValidator) Report(family string, msg mqtt.Message, report interface{}) {
+	if v == nil {
+		return
+	}
+
+	id := mq.TopicID(msg.Topic())
+	if id == "" {
+		return
+	}
+
+	options := mq.DefaultMessageOptions()
+	options.Qos = 1
+	options.Retained = false
+
+	errorTopic := v.topicManager.GetErrorTopic(family, id)
+	if err := v.client.PublishJsonWithOptions(errorTopic, report, options); err != nil {
+		v.logger.Error().Err(err).
+			Str("topic", errorTopic).
+			Msg("Failed to publish validation errors")
+	}
+}
+
+func (v *PayloadValidator) InstanceID() string {
+	if v == nil {
+		return ""
+	}
+	return v.client.InstanceID()
+}
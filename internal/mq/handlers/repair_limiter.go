@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// RepairLimiter allows at most one repair per topic within interval, so a
+// device that keeps publishing bad payloads cannot cause a publish storm.
+type RepairLimiter struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func NewRepairLimiter(interval time.Duration) *RepairLimiter {
+	return &RepairLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+func (l *RepairLimiter) Allow(topic string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if last, exists := l.last[topic]; exists && now.Sub(last) < l.interval {
+		return false
+	}
+
+	l.last[topic] = now
+	l.prune(now)
+	return true
+}
+
+func (l *RepairLimiter) prune(now time.Time) {
+	if len(l.last) < 1024 {
+		return
+	}
+
+	for topic, last := range l.last {
+		if now.Sub(last) >= l.interval {
+			delete(l.last, topic)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"errors"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq"
+)
+
+// Replier answers inbound messages, on the MQTT 5 response topic when the
+// sender set one and on a fallback topic otherwise.
+type Replier struct {
+	client *mq.Client
+	logger zerolog.Logger
+}
+
+func NewReplier(client *mq.Client, logger zerolog.Logger) *Replier {
+	return &Replier{
+		client: client,
+		logger: logger,
+	}
+}
+
+func (r *Replier) Reply(msg mqtt.Message, fallbackTopic string, report interface{}) {
+	if r == nil {
+		return
+	}
+
+	err := r.client.Reply(msg, report)
+	topic := "response topic"
+	if errors.Is(err, mq.ErrNoResponseTopic) {
+		options := mq.DefaultMessageOptions()
+		options.Qos = 1
+		options.Retained = false
+
+		topic = fallbackTopic
+		err = r.client.PublishJsonWithOptions(fallbackTopic, report, options)
+	}
+
+	if err != nil {
+		r.logger.Error().Err(err).
+			Str("topic", msg.Topic()).
+			Str("reply_topic", topic).
+			Msg("Failed to reply to message")
+	}
+}
@@ -1,25 +1,22 @@
 package handlers
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/rs/zerolog"
 	"gps-no-sync/internal/mq"
+	"gps-no-sync/internal/mq/schemas"
 	"gps-no-sync/internal/services"
-	"time"
 )
 
 var (
-	ErrEmptyMessage       = errors.New("empty message received")
-	ErrSyncMessageIgnored = errors.New("sync message ignored")
-	ErrInvalidMessage     = errors.New("invalid message format")
-	ErrValidationFailed   = errors.New("validation failed")
-	ErrStationNotFound    = errors.New("station not found")
-	ErrMessageIsNil       = errors.New("message is nil")
+	ErrEmptyMessage     = errors.New("empty message received")
+	ErrInvalidMessage   = errors.New("invalid message format")
+	ErrValidationFailed = errors.New("validation failed")
+	ErrStationNotFound  = errors.New("station not found")
+	ErrMessageIsNil     = errors.New("message is nil")
 )
 
 type StationHandler struct {
@@ -27,18 +24,30 @@ type StationHandler struct {
 	logger         zerolog.Logger
 	handlerTopic   string
 	topicManager   *mq.TopicManager
+	payloads       *PayloadValidator
+	deadLetters    *mq.DeadLetterQueue
+	repairs        *RepairLimiter
+	replies        *Replier
 }
 
 func NewStationHandler(
 	stationService *services.StationService,
 	logger zerolog.Logger,
 	topicManager *mq.TopicManager,
+	payloads *PayloadValidator,
+	deadLetters *mq.DeadLetterQueue,
+	repairs *RepairLimiter,
+	replies *Replier,
 ) *StationHandler {
 	return &StationHandler{
 		stationService: stationService,
 		logger:         logger,
 		handlerTopic:   topicManager.GetStationTopic(),
 		topicManager:   topicManager,
+		payloads:       payloads,
+		deadLetters:    deadLetters,
+		repairs:        repairs,
+		replies:        replies,
 	}
 }
 
@@ -54,44 +63,43 @@ func (h *StationHandler) TransformMessage(ctx context.Context, msg mqtt.Message)
 	}
 
 	var stationMessage mq.StationMessage
-	if err := json.Unmarshal(msg.Payload(), &stationMessage); err != nil {
-		//TODO: Sync just the station that failed validation (same for clusters)
-		err := h.stationService.SyncAll(ctx)
-		if err != nil {
-			h.logger.Error().Err(err).
-				Str("topic", msg.Topic()).
-				Msg("Failed to sync all stations after invalid message")
-			return nil, fmt.Errorf("failed to sync stations: %w", err)
-		}
+	provenance, err := h.payloads.Decode(schemas.FamilyStations, msg, &stationMessage.Data)
+	if err != nil {
+		h.repair(ctx, msg.Topic())
 
-		return nil, fmt.Errorf("could not parse station data: %w", ErrInvalidMessage)
+		return nil, fmt.Errorf("could not parse station data: %w", err)
 	}
+	stationMessage.Provenance = provenance
 	stationMessage.Topic = msg.Topic()
 
-	byteStationMessage, err := json.Marshal(stationMessage)
-	if err != nil {
-		h.logger.Error().Err(err).
-			Str("topic", msg.Topic()).
-			Msg("Failed to marshal station message")
-		return nil, fmt.Errorf("failed to marshal station message: %w", err)
+	// Valid but non-canonical messages need no repair here, processing them
+	// republishes the canonical state of the station anyway.
+
+	return &stationMessage, nil
+}
+
+// repair restores the retained state of the station a malformed message was
+// published for.
+func (h *StationHandler) repair(ctx context.Context, topic string) {
+	if h.repairs != nil && !h.repairs.Allow(topic) {
+		h.logger.Debug().Str("topic", topic).Msg("Skipping station repair, repaired recently")
+		return
 	}
 
-	if !bytes.Equal(msg.Payload(), byteStationMessage) {
-		err := h.stationService.SyncAll(ctx)
-		if err != nil {
-			h.logger.Error().Err(err).
-				Str("topic", msg.Topic()).
-				Msg("Failed to sync all stations after invalid message")
-		}
+	topicID, err := h.topicManager.ExtractStationId(topic)
+	if err != nil {
+		h.logger.Warn().Err(err).Msg("Cannot repair station of unexpected topic")
+		return
 	}
 
-	return &stationMessage, nil
+	if err := h.stationService.Repair(ctx, topicID); err != nil {
+		h.logger.Error().Err(err).
+			Str("topic", topic).
+			Msg("Failed to repair station after invalid message")
+	}
 }
 
-func (h *StationHandler) HandleMessage(client mqtt.Client, msg mqtt.Message) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
+func (h *StationHandler) HandleMessage(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
 	topic := msg.Topic()
 
 	stationMessage, err := h.TransformMessage(ctx, msg)
@@ -104,8 +112,69 @@ func (h *StationHandler) HandleMessage(client mqtt.Client, msg mqtt.Message) {
 			Str("message", string(msg.Payload())).
 			Str("topic", topic).
 			Msg("Failed to transform message")
+		deadLetter(h.deadLetters, h.logger, msg, err)
+		return
+	}
+
+	if err := h.stationService.ProcessMessage(ctx, stationMessage); err != nil {
+		var conflict *services.ConflictError
+		if errors.As(err, &conflict) {
+			h.replies.Reply(msg, h.topicManager.GetConflictTopic(schemas.FamilyStations, mq.TopicID(topic)), conflict.Conflict)
+			return
+		}
+
+		h.logger.Error().Err(err).
+			Str("topic", topic).
+			Msg("Failed to process station message")
+	}
+}
+
+// HandlePatch applies a JSON merge patch published to
+// {base}/v1/stations/{topic}/patch.
+func (h *StationHandler) HandlePatch(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+	topic := msg.Topic()
+
+	// A retained patch would be applied again on every subscribe, reverting
+	// all later changes of the patched fields.
+	if len(msg.Payload()) == 0 || msg.Retained() {
+		return
+	}
+
+	patch, provenance, err := mq.UnwrapMessage(msg)
+	if err != nil || len(patch) == 0 {
+		// Devices may publish the bare patch document.
+		patch = msg.Payload()
+		provenance = mq.MessageProvenance(msg)
+	}
+
+	validate := func(data []byte) error {
+		return h.payloads.Validate(schemas.FamilyStations, msg, data)
+	}
+
+	err = h.stationService.ApplyPatch(ctx, mq.TopicID(topic), patch, provenance, validate)
+	if err == nil {
 		return
 	}
 
-	h.stationService.ProcessMessage(ctx, stationMessage)
+	var conflict *services.ConflictError
+	if errors.As(err, &conflict) {
+		h.replies.Reply(msg, h.topicManager.GetConflictTopic(schemas.FamilyStations, mq.TopicID(topic)), conflict.Conflict)
+		return
+	}
+
+	if errors.Is(err, services.ErrInvalidPatch) || errors.Is(err, services.ErrUnknownStation) ||
+		errors.Is(err, services.ErrStationNotApproved) {
+		err = fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+
+	h.logger.Error().Err(err).
+		Str("message", string(msg.Payload())).
+		Str("topic", topic).
+		Msg("Failed to apply station patch")
+
+	// Only rejected patches are dead-lettered, database errors are not the
+	// sender's fault.
+	if errors.Is(err, ErrInvalidMessage) || errors.Is(err, ErrValidationFailed) {
+		deadLetter(h.deadLetters, h.logger, msg, err)
+	}
 }
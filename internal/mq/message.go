@@ -1,13 +1,15 @@
 package mq
 
 import (
+	"encoding/json"
 	"gps-no-sync/internal/models"
+	"time"
 )
 
 type StationMessage struct {
-	Data   models.StationDto `json:"data"`
-	Source string            `json:"source"`
-	Topic  string            `json:"topic"`
+	Data models.StationDto `json:"data"`
+	Provenance
+	Topic string `json:"topic"`
 }
 
 type StationConfig struct {
@@ -19,13 +21,62 @@ type UWB struct {
 }
 
 type ClusterMessage struct {
-	Data   models.ClusterDto `json:"data"`
-	Source string            `json:"source"`
-	Topic  string            `json:"topic"`
+	Data models.ClusterDto `json:"data"`
+	Provenance
+	Topic string `json:"topic"`
+	// HasCredential is set when the message was published with a credential,
+	// see Authorization.
+	HasCredential bool `json:"-"`
 }
 
 type MeasurementMessage struct {
-	Data   models.Measurement `json:"data"`
-	Source string             `json:"source"`
-	Topic  string             `json:"topic"`
+	Data models.Measurement `json:"data"`
+	Provenance
+	Topic string `json:"topic"`
+}
+
+// MeasurementBatchMessage carries all measurements of one message, which may
+// have been published as a single measurement, an array or a
+// {"measurements": [...]} object.
+type MeasurementBatchMessage struct {
+	Data []models.Measurement `json:"data"`
+	Provenance
+	Topic      string    `json:"topic"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+const (
+	CommandAckStatusOK    = "ok"
+	CommandAckStatusError = "error"
+)
+
+// CommandRequest is published to {base}/v1/stations/{topic}/cmd. Retries
+// carry the same id with a higher attempt.
+type CommandRequest struct {
+	ID       string                 `json:"id"`
+	Command  models.CommandName     `json:"command"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Attempt  int                    `json:"attempt"`
+	IssuedAt time.Time              `json:"issued_at"`
+}
+
+// CommandAck is published by a station to {base}/v1/stations/{topic}/cmd/ack.
+type CommandAck struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+const (
+	StationStatusOnline  = "online"
+	StationStatusOffline = "offline"
+)
+
+// StationStatus is published retained to {base}/v1/stations/{topic}/status
+// whenever a station comes online or goes offline.
+type StationStatus struct {
+	Status     string     `json:"status"`
+	LastSeenAt *time.Time `json:"last_seen_at"`
+	ChangedAt  time.Time  `json:"changed_at"`
 }
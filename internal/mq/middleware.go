@@ -0,0 +1,155 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"runtime/debug"
+	"time"
+)
+
+var (
+	ErrHandlerPanic    = errors.New("message handler panicked")
+	ErrPayloadTooLarge = errors.New("payload too large")
+)
+
+// HandlerFunc processes a single inbound message.
+type HandlerFunc func(ctx context.Context, client mqtt.Client, msg mqtt.Message)
+
+// Middleware wraps a HandlerFunc, e.g. to skip, time or guard the messages
+// passed on to next.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// RejectFunc receives messages a middleware refused to pass on.
+type RejectFunc func(msg mqtt.Message, reason error)
+
+// Pipeline applies a chain of middleware to message handlers. The first
+// middleware added is the outermost one.
+type Pipeline struct {
+	middlewares []Middleware
+}
+
+func NewPipeline(middlewares ...Middleware) *Pipeline {
+	return &Pipeline{middlewares: middlewares}
+}
+
+// Use appends middlewares to the chain. It only affects handlers created by
+// Then afterwards.
+func (p *Pipeline) Use(middlewares ...Middleware) {
+	p.middlewares = append(p.middlewares, middlewares...)
+}
+
+// Then wraps handler in the pipeline followed by extra, which only applies to
+// this handler, and returns it as paho message handler.
+func (p *Pipeline) Then(handler HandlerFunc, extra ...Middleware) mqtt.MessageHandler {
+	chain := make([]Middleware, 0, len(p.middlewares)+len(extra))
+	chain = append(chain, p.middlewares...)
+	chain = append(chain, extra...)
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+
+	return func(client mqtt.Client, msg mqtt.Message) {
+		handler(context.Background(), client, msg)
+	}
+}
+
+// Recover turns a panicking handler into a logged, rejected message.
+func Recover(logger zerolog.Logger, reject RejectFunc) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error().
+						Str("topic", msg.Topic()).
+						Interface("panic", r).
+						Str("stack", string(debug.Stack())).
+						Msg("Message handler panicked")
+
+					if reject != nil {
+						reject(msg, fmt.Errorf("%w: %v", ErrHandlerPanic, r))
+					}
+				}
+			}()
+
+			next(ctx, client, msg)
+		}
+	}
+}
+
+// Logging attaches a logger with the message's topic, family and id to the
+// context, retrievable with zerolog.Ctx, and logs every handled message.
+func Logging(logger zerolog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+			topic := msg.Topic()
+			requestLogger := logger.With().
+				Str("topic", topic).
+				Str("family", TopicFamily(topic)).
+				Str("id", TopicID(topic)).
+				Uint16("message_id", msg.MessageID()).
+				Logger()
+
+			receivedAt := ReceivedAt(msg)
+			start := time.Now()
+			next(requestLogger.WithContext(ctx), client, msg)
+
+			requestLogger.Debug().
+				Int("payload_size", len(msg.Payload())).
+				Uint8("qos", msg.Qos()).
+				Bool("retained", msg.Retained()).
+				Dur("queued", start.Sub(receivedAt)).
+				Dur("duration", time.Since(start)).
+				Msg("Handled message")
+		}
+	}
+}
+
+// Timing warns about handlers that take longer than threshold.
+func Timing(logger zerolog.Logger, threshold time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+			start := time.Now()
+			next(ctx, client, msg)
+
+			if elapsed := time.Since(start); elapsed > threshold {
+				logger.Warn().
+					Str("topic", msg.Topic()).
+					Dur("duration", elapsed).
+					Dur("threshold", threshold).
+					Msg("Slow message handler")
+			}
+		}
+	}
+}
+
+// PayloadLimit rejects messages with payloads larger than maxBytes.
+func PayloadLimit(maxBytes int, reject RejectFunc) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+			if size := len(msg.Payload()); size > maxBytes {
+				if reject != nil {
+					reject(msg, fmt.Errorf("%w: %d bytes exceeds limit of %d bytes", ErrPayloadTooLarge, size, maxBytes))
+				}
+				return
+			}
+
+			next(ctx, client, msg)
+		}
+	}
+}
+
+// Deadline bounds the context passed to the handler by timeout.
+func Deadline(timeout time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, client mqtt.Client, msg mqtt.Message) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			next(ctx, client, msg)
+		}
+	}
+}
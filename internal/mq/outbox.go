@@ -0,0 +1,199 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/mq/schemas"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type outboxEntry struct {
+	Sequence uint64         `json:"sequence"`
+	Topic    string         `json:"topic"`
+	Payload  []byte         `json:"payload"`
+	Options  MessageOptions `json:"options"`
+	QueuedAt time.Time      `json:"queued_at"`
+}
+
+// replayOptions returns the options to publish entry with at now. The message
+// expiry counts from the original publish, so it is shortened by the time the
+// entry spent in the outbox, and false is returned once it has run out.
+func (e outboxEntry) replayOptions(now time.Time) (*MessageOptions, bool) {
+	options := e.Options
+	if options.MessageExpiry > 0 {
+		options.MessageExpiry -= now.Sub(e.QueuedAt)
+		// The expiry is sent in whole seconds, and zero would disable it.
+		if options.MessageExpiry < time.Second {
+			return nil, false
+		}
+	}
+	return &options, true
+}
+
+// isOutboxTopic reports whether publishes to topic are kept in the outbox.
+// Only the retained state of stations and clusters is, as other retained
+// documents such as presence, liveness status or dead letters would be stale
+// by the time the outbox is drained.
+func isOutboxTopic(topic string) bool {
+	family, id := TopicFamily(topic), TopicID(topic)
+	if family != schemas.FamilyStations && family != schemas.FamilyClusters || id == "" {
+		return false
+	}
+	return strings.HasSuffix(topic, "/v1/"+family+"/"+id)
+}
+
+// Outbox is a disk-backed queue for retained station and cluster publishes that
+// could not be delivered to the broker. Entries are coalesced per topic so only
+// the latest value is kept.
+type Outbox struct {
+	path       string
+	maxEntries int
+	logger     zerolog.Logger
+
+	mu       sync.Mutex
+	entries  map[string]*outboxEntry
+	sequence uint64
+}
+
+func NewOutbox(path string, maxEntries int, logger zerolog.Logger) (*Outbox, error) {
+	outbox := &Outbox{
+		path:       path,
+		maxEntries: maxEntries,
+		logger:     logger,
+		entries:    make(map[string]*outboxEntry),
+	}
+
+	if err := outbox.load(); err != nil {
+		return nil, fmt.Errorf("failed to load outbox from %s: %w", path, err)
+	}
+
+	if len(outbox.entries) > 0 {
+		logger.Info().
+			Str("path", path).
+			Int("entries", len(outbox.entries)).
+			Msg("Loaded pending publishes from outbox")
+	}
+
+	return outbox, nil
+}
+
+func (o *Outbox) Enqueue(topic string, payload []byte, options *MessageOptions) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, exists := o.entries[topic]; !exists && o.maxEntries > 0 && len(o.entries) >= o.maxEntries {
+		oldest := o.sortedLocked()[0]
+		delete(o.entries, oldest.Topic)
+		o.logger.Warn().
+			Str("topic", oldest.Topic).
+			Int("max_entries", o.maxEntries).
+			Msg("Outbox is full, dropped oldest pending publish")
+	}
+
+	o.sequence++
+	o.entries[topic] = &outboxEntry{
+		Sequence: o.sequence,
+		Topic:    topic,
+		Payload:  payload,
+		Options:  *options,
+		QueuedAt: time.Now(),
+	}
+
+	return o.persistLocked()
+}
+
+func (o *Outbox) Pending() []outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.sortedLocked()
+}
+
+// Remove drops the delivered entries, unless a newer value for the same topic
+// was queued while they were being published.
+func (o *Outbox) Remove(delivered []outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, entry := range delivered {
+		if current, exists := o.entries[entry.Topic]; exists && current.Sequence == entry.Sequence {
+			delete(o.entries, entry.Topic)
+		}
+	}
+
+	return o.persistLocked()
+}
+
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.entries)
+}
+
+func (o *Outbox) sortedLocked() []outboxEntry {
+	entries := make([]outboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Sequence < entries[j].Sequence
+	})
+
+	return entries
+}
+
+func (o *Outbox) load() error {
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []outboxEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	for i := range entries {
+		entry := entries[i]
+		o.entries[entry.Topic] = &entry
+		if entry.Sequence > o.sequence {
+			o.sequence = entry.Sequence
+		}
+	}
+
+	return nil
+}
+
+func (o *Outbox) persistLocked() error {
+	data, err := json.Marshal(o.sortedLocked())
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	tmpPath := o.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return fmt.Errorf("failed to replace outbox: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package mq
+
+import (
+	"github.com/rs/zerolog"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type outboxPublish struct {
+	topic   string
+	payload string
+}
+
+func TestOutboxCoalescesPerTopic(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		publishes  []outboxPublish
+		want       []outboxPublish
+	}{
+		{
+			name:      "distinct topics keep queue order",
+			publishes: []outboxPublish{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+			want:      []outboxPublish{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+		},
+		{
+			name:      "same topic keeps latest value",
+			publishes: []outboxPublish{{"a", "1"}, {"a", "2"}, {"a", "3"}},
+			want:      []outboxPublish{{"a", "3"}},
+		},
+		{
+			name:      "replaced topic moves to the end",
+			publishes: []outboxPublish{{"a", "1"}, {"b", "2"}, {"a", "3"}},
+			want:      []outboxPublish{{"b", "2"}, {"a", "3"}},
+		},
+		{
+			name:       "full outbox drops oldest topic",
+			maxEntries: 2,
+			publishes:  []outboxPublish{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+			want:       []outboxPublish{{"b", "2"}, {"c", "3"}},
+		},
+		{
+			name:       "full outbox replaces known topic without dropping",
+			maxEntries: 2,
+			publishes:  []outboxPublish{{"a", "1"}, {"b", "2"}, {"a", "3"}},
+			want:       []outboxPublish{{"b", "2"}, {"a", "3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "outbox.json")
+			outbox := newTestOutbox(t, path, tt.maxEntries)
+
+			for _, publish := range tt.publishes {
+				if err := outbox.Enqueue(publish.topic, []byte(publish.payload), DefaultMessageOptions()); err != nil {
+					t.Fatalf("Enqueue(%s) failed: %v", publish.topic, err)
+				}
+			}
+
+			if got := pendingPublishes(outbox); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pending = %v, want %v", got, tt.want)
+			}
+
+			reloaded := newTestOutbox(t, path, tt.maxEntries)
+			if got := pendingPublishes(reloaded); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pending after reload = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxPersistsOptionsAndSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	outbox := newTestOutbox(t, path, 0)
+
+	options := DefaultMessageOptions()
+	options.Qos = 1
+	options.ContentType = "application/json"
+	options.MessageExpiry = time.Minute
+	options.ResponseTopic = "gps-no/v1/stations/a1/reports"
+	options.CorrelationData = []byte("c1")
+	options.UserProperties = map[string]string{"source": SourceSync}
+	if err := outbox.Enqueue("a", []byte("1"), options); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+
+	reloaded := newTestOutbox(t, path, 0)
+	pending := reloaded.Pending()
+	if len(pending) != 1 {
+		t.Fatalf("got %d pending entries, want 1", len(pending))
+	}
+	entry := pending[0]
+	if !reflect.DeepEqual(entry.Options, *options) {
+		t.Errorf("options = %+v, want %+v", entry.Options, *options)
+	}
+
+	if err := reloaded.Enqueue("b", []byte("2"), options); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if pending := reloaded.Pending(); pending[1].Sequence <= entry.Sequence {
+		t.Errorf("sequence %d after reload does not continue after %d", pending[1].Sequence, entry.Sequence)
+	}
+}
+
+func TestOutboxRemove(t *testing.T) {
+	tests := []struct {
+		name      string
+		requeue   []outboxPublish
+		wantAfter []outboxPublish
+	}{
+		{
+			name:      "delivered entries are removed",
+			wantAfter: []outboxPublish{},
+		},
+		{
+			name:      "values queued during delivery are kept",
+			requeue:   []outboxPublish{{"a", "3"}},
+			wantAfter: []outboxPublish{{"a", "3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "outbox.json")
+			outbox := newTestOutbox(t, path, 0)
+
+			for _, publish := range []outboxPublish{{"a", "1"}, {"b", "2"}} {
+				if err := outbox.Enqueue(publish.topic, []byte(publish.payload), DefaultMessageOptions()); err != nil {
+					t.Fatalf("Enqueue(%s) failed: %v", publish.topic, err)
+				}
+			}
+			delivered := outbox.Pending()
+
+			for _, publish := range tt.requeue {
+				if err := outbox.Enqueue(publish.topic, []byte(publish.payload), DefaultMessageOptions()); err != nil {
+					t.Fatalf("Enqueue(%s) failed: %v", publish.topic, err)
+				}
+			}
+
+			if err := outbox.Remove(delivered); err != nil {
+				t.Fatalf("Remove failed: %v", err)
+			}
+
+			if got := pendingPublishes(outbox); !reflect.DeepEqual(got, tt.wantAfter) {
+				t.Errorf("pending = %v, want %v", got, tt.wantAfter)
+			}
+			if got := pendingPublishes(newTestOutbox(t, path, 0)); !reflect.DeepEqual(got, tt.wantAfter) {
+				t.Errorf("pending after reload = %v, want %v", got, tt.wantAfter)
+			}
+		})
+	}
+}
+
+func newTestOutbox(t *testing.T, path string, maxEntries int) *Outbox {
+	t.Helper()
+
+	outbox, err := NewOutbox(path, maxEntries, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewOutbox failed: %v", err)
+	}
+	return outbox
+}
+
+func pendingPublishes(outbox *Outbox) []outboxPublish {
+	publishes := make([]outboxPublish, 0, outbox.Len())
+	for _, entry := range outbox.Pending() {
+		publishes = append(publishes, outboxPublish{entry.Topic, string(entry.Payload)})
+	}
+	return publishes
+}
+
+func TestOutboxEntryReplayOptions(t *testing.T) {
+	queuedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		expiry     time.Duration
+		queuedFor  time.Duration
+		wantExpiry time.Duration
+		wantValid  bool
+	}{
+		{name: "no expiry", queuedFor: time.Hour, wantValid: true},
+		{name: "expiry is shortened", expiry: time.Minute, queuedFor: 20 * time.Second, wantExpiry: 40 * time.Second, wantValid: true},
+		{name: "expired", expiry: time.Minute, queuedFor: time.Minute},
+		{name: "less than a second left", expiry: time.Minute, queuedFor: 59500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := outboxEntry{
+				Topic:    "gps-no/v1/stations/a1",
+				Options:  MessageOptions{Qos: 1, Retained: true, ResponseTopic: "reply", MessageExpiry: tt.expiry},
+				QueuedAt: queuedAt,
+			}
+
+			options, valid := entry.replayOptions(queuedAt.Add(tt.queuedFor))
+			if valid != tt.wantValid {
+				t.Fatalf("valid = %v, want %v", valid, tt.wantValid)
+			}
+			if !valid {
+				return
+			}
+			if options.MessageExpiry != tt.wantExpiry || options.Qos != 1 || !options.Retained || options.ResponseTopic != "reply" {
+				t.Errorf("options = %+v, want expiry %v and the queued options", options, tt.wantExpiry)
+			}
+			if entry.Options.MessageExpiry != tt.expiry {
+				t.Errorf("replayOptions changed the queued entry")
+			}
+		})
+	}
+}
+
+func TestIsOutboxTopic(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{topic: "gps-no/v1/stations/a1", want: true},
+		{topic: "gps-no/v1/clusters/7", want: true},
+		{topic: "site/gps-no/v1/clusters/7", want: true},
+		{topic: "gps-no/v1/stations/a1/status"},
+		{topic: "gps-no/v1/stations/a1/cmd"},
+		{topic: "gps-no/v1/clusters/7/reports"},
+		{topic: "gps-no/v1/services/sync-1/status"},
+		{topic: "gps-no/v1/dlq/stations/a1"},
+		{topic: "gps-no/v1/measurements/a1"},
+		{topic: "gps-no/v1/stations"},
+		{topic: "stations/a1"},
+	}
+
+	for _, tt := range tests {
+		if got := isOutboxTopic(tt.topic); got != tt.want {
+			t.Errorf("isOutboxTopic(%s) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package mq
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ServiceStatusTopicTemplate = "%s/v1/services/%s/status"
+
+	ServiceStatusOnline  = "online"
+	ServiceStatusOffline = "offline"
+)
+
+type ServiceStatus struct {
+	Status     string    `json:"status"`
+	Version    string    `json:"version"`
+	InstanceID string    `json:"instance_id"`
+	ClientID   string    `json:"client_id"`
+	StartedAt  time.Time `json:"started_at"`
+	Topics     []string  `json:"topics"`
+	Leader     bool      `json:"leader"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type presence struct {
+	topic      string
+	version    string
+	instanceID string
+	clientID   string
+	startedAt  time.Time
+	leader     atomic.Bool
+}
+
+// newPresence creates the status document of this instance. The topic is keyed
+// on the stable instance name rather than the per-connection client id, so a
+// restarted replica replaces its previous status.
+func newPresence(baseTopic, instanceName, clientID, instanceID, version string) *presence {
+	return &presence{
+		topic:      fmt.Sprintf(ServiceStatusTopicTemplate, strings.TrimSuffix(baseTopic, "/"), instanceName),
+		version:    version,
+		instanceID: instanceID,
+		clientID:   clientID,
+		startedAt:  time.Now().UTC(),
+	}
+}
+
+func (p *presence) status(status string, subscriptions []string) ServiceStatus {
+	return ServiceStatus{
+		Status:     status,
+		Version:    p.version,
+		InstanceID: p.instanceID,
+		ClientID:   p.clientID,
+		StartedAt:  p.startedAt,
+		Topics:     topicFamilies(subscriptions),
+		Leader:     p.leader.Load(),
+		UpdatedAt:  time.Now().UTC(),
+	}
+}
+
+// topicFamilies reduces subscription filters such as "gps-no/v1/stations/+" to
+// their family name ("stations").
+func topicFamilies(subscriptions []string) []string {
+	seen := make(map[string]bool)
+	families := make([]string, 0, len(subscriptions))
+
+	for _, topic := range subscriptions {
+		family := TopicFamily(topic)
+		if family == "" || seen[family] {
+			continue
+		}
+		seen[family] = true
+		families = append(families, family)
+	}
+
+	sort.Strings(families)
+	return families
+}
+
+// TopicFamily returns the path segment following the API version of topic.
+func TopicFamily(topic string) string {
+	_, rest, found := strings.Cut(topic, "/v1/")
+	if !found {
+		return ""
+	}
+
+	family, _, _ := strings.Cut(rest, "/")
+	return family
+}
+
+// TopicID returns the path segment following the topic family, usually the
+// station or cluster id.
+func TopicID(topic string) string {
+	_, rest, found := strings.Cut(topic, "/v1/")
+	if !found {
+		return ""
+	}
+
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// TopicSuffix returns everything following the id segment of topic, such as
+// the encoding of a measurement topic.
+func TopicSuffix(topic string) string {
+	_, rest, found := strings.Cut(topic, "/v1/")
+	if !found {
+		return ""
+	}
+
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
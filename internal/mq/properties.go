@@ -0,0 +1,130 @@
+package mq
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"time"
+)
+
+const (
+	ContentTypeJSON           = "application/json"
+	UserPropertySource        = "source"
+	UserPropertyAuthorization = "authorization"
+)
+
+// Properties carries the MQTT 5 publish properties of an inbound message.
+type Properties struct {
+	ContentType     string
+	ResponseTopic   string
+	CorrelationData []byte
+	MessageExpiry   time.Duration
+	UserProperties  map[string]string
+}
+
+type propertiesCarrier interface {
+	Properties() *Properties
+}
+
+// PropertiesOf returns the MQTT 5 properties of msg, or nil when the message was
+// received over MQTT 3.1.1.
+func PropertiesOf(msg mqtt.Message) *Properties {
+	if carrier, ok := msg.(propertiesCarrier); ok {
+		return carrier.Properties()
+	}
+	return nil
+}
+
+func (p *Properties) hasProvenance() bool {
+	if p == nil {
+		return false
+	}
+	_, hasSource := p.UserProperties[UserPropertySource]
+	return hasSource || p.ContentType != ""
+}
+
+type rawEnvelope struct {
+	Data json.RawMessage `json:"data"`
+	Provenance
+}
+
+// UnwrapMessage returns the data part of msg and its provenance. MQTT 5
+// messages that carry a content-type or source user property are treated as
+// bare payloads, everything else is expected to be wrapped in the JSON Message
+// envelope.
+func UnwrapMessage(msg mqtt.Message) (json.RawMessage, Provenance, error) {
+	if properties := PropertiesOf(msg); properties.hasProvenance() {
+		return msg.Payload(), provenanceFromUserProperties(properties.UserProperties), nil
+	}
+
+	var envelope rawEnvelope
+	if err := json.Unmarshal(msg.Payload(), &envelope); err != nil {
+		return nil, Provenance{}, err
+	}
+
+	return envelope.Data, envelope.Provenance, nil
+}
+
+// MessageProvenance returns the provenance carried in the MQTT 5 user
+// properties of msg, for payloads that cannot hold the JSON envelope.
+func MessageProvenance(msg mqtt.Message) Provenance {
+	if properties := PropertiesOf(msg); properties != nil {
+		return provenanceFromUserProperties(properties.UserProperties)
+	}
+	return Provenance{}
+}
+
+// Authorization returns the credential msg was published with, taken from the
+// MQTT 5 authorization user property or the authorization field of the JSON
+// envelope. Sync instances never publish credentials, and cluster documents
+// carrying one are rejected, as every subscriber of the cluster topic reads it.
+func Authorization(msg mqtt.Message) string {
+	if properties := PropertiesOf(msg); properties != nil {
+		if token := properties.UserProperties[UserPropertyAuthorization]; token != "" {
+			return token
+		}
+	}
+
+	var envelope struct {
+		Authorization string `json:"authorization"`
+	}
+	if err := json.Unmarshal(msg.Payload(), &envelope); err != nil {
+		return ""
+	}
+	return envelope.Authorization
+}
+
+// DecodeMessage unmarshals the data part of msg into data and returns the
+// provenance of the message.
+func DecodeMessage(msg mqtt.Message, data interface{}) (Provenance, error) {
+	raw, provenance, err := UnwrapMessage(msg)
+	if err != nil {
+		return Provenance{}, err
+	}
+
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, data); err != nil {
+			return Provenance{}, fmt.Errorf("invalid data: %w", err)
+		}
+	}
+
+	return provenance, nil
+}
+
+// IsCanonical reports whether msg carries exactly the encoding this service
+// would publish for data.
+func IsCanonical(msg mqtt.Message, provenance Provenance, data interface{}) bool {
+	var expected []byte
+	var err error
+
+	if PropertiesOf(msg).hasProvenance() {
+		expected, err = json.Marshal(data)
+	} else {
+		expected, err = json.Marshal(Message{Data: data, Provenance: provenance})
+	}
+	if err != nil {
+		return false
+	}
+
+	return string(expected) == string(msg.Payload())
+}
@@ -0,0 +1,67 @@
+package mq
+
+import (
+	"context"
+	"strconv"
+)
+
+const (
+	SourceSync = "SYNC"
+
+	UserPropertyOrigin        = "origin"
+	UserPropertySequence      = "sequence"
+	UserPropertyCorrelationID = "correlation_id"
+	UserPropertyHops          = "hops"
+)
+
+// Provenance describes where a message originated. Origin is the instance id of
+// the publishing sync instance, Sequence is monotonic per origin and Hops counts
+// how often the message was re-published in reaction to another message.
+type Provenance struct {
+	Source        string `json:"source"`
+	Origin        string `json:"origin,omitempty"`
+	Sequence      uint64 `json:"sequence,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Hops          int    `json:"hops,omitempty"`
+}
+
+type provenanceKey struct{}
+
+// WithProvenance marks ctx as processing a message with the given provenance, so
+// that publishes made in reaction to it carry the correlation id and hop count.
+func WithProvenance(ctx context.Context, provenance Provenance) context.Context {
+	return context.WithValue(ctx, provenanceKey{}, provenance)
+}
+
+func ProvenanceFromContext(ctx context.Context) (Provenance, bool) {
+	provenance, ok := ctx.Value(provenanceKey{}).(Provenance)
+	return provenance, ok
+}
+
+func (p Provenance) userProperties() map[string]string {
+	properties := map[string]string{
+		UserPropertySource: p.Source,
+	}
+
+	if p.Origin != "" {
+		properties[UserPropertyOrigin] = p.Origin
+		properties[UserPropertySequence] = strconv.FormatUint(p.Sequence, 10)
+		properties[UserPropertyCorrelationID] = p.CorrelationID
+		properties[UserPropertyHops] = strconv.Itoa(p.Hops)
+	}
+
+	return properties
+}
+
+func provenanceFromUserProperties(properties map[string]string) Provenance {
+	provenance := Provenance{
+		Source:        properties[UserPropertySource],
+		Origin:        properties[UserPropertyOrigin],
+		CorrelationID: properties[UserPropertyCorrelationID],
+	}
+
+	provenance.Sequence, _ = strconv.ParseUint(properties[UserPropertySequence], 10, 64)
+	provenance.Hops, _ = strconv.Atoi(properties[UserPropertyHops])
+
+	return provenance
+}
@@ -0,0 +1,50 @@
+package mq
+
+import (
+	"context"
+	"testing"
+)
+
+func TestClientIsEcho(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxHops    int
+		provenance Provenance
+		want       bool
+	}{
+		{name: "own origin", maxHops: 3, provenance: Provenance{Origin: "self"}, want: true},
+		{name: "other origin", maxHops: 3, provenance: Provenance{Origin: "other", Hops: 1}},
+		{name: "device message", maxHops: 3, provenance: Provenance{}},
+		{name: "below hop limit", maxHops: 3, provenance: Provenance{Origin: "other", Hops: 2}},
+		{name: "at hop limit", maxHops: 3, provenance: Provenance{Origin: "other", Hops: 3}, want: true},
+		{name: "above hop limit", maxHops: 3, provenance: Provenance{Hops: 7}, want: true},
+		{name: "hop limit disabled", maxHops: 0, provenance: Provenance{Origin: "other", Hops: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &Client{instanceID: "self", maxHops: tt.maxHops}
+			if got := client.IsEcho(tt.provenance); got != tt.want {
+				t.Errorf("IsEcho(%+v) = %v, want %v", tt.provenance, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientNewProvenanceCountsHops(t *testing.T) {
+	client := &Client{instanceID: "self", maxHops: 3}
+
+	first := client.newProvenance(context.Background(), SourceSync)
+	if first.Origin != "self" || first.Hops != 0 || first.CorrelationID == "" {
+		t.Fatalf("unexpected provenance %+v", first)
+	}
+
+	parent := Provenance{Origin: "other", CorrelationID: "c1", Hops: 1}
+	reply := client.newProvenance(WithProvenance(context.Background(), parent), SourceSync)
+	if reply.Hops != 2 || reply.CorrelationID != "c1" {
+		t.Errorf("reply provenance = %+v, want hop 2 of correlation c1", reply)
+	}
+	if first.Sequence >= reply.Sequence {
+		t.Errorf("sequence did not increase: %d, %d", first.Sequence, reply.Sequence)
+	}
+}
@@ -0,0 +1,165 @@
+package schemas
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"sort"
+	"strings"
+)
+
+const (
+	Version = "v1"
+
+	FamilyStations     = "stations"
+	FamilyClusters     = "clusters"
+	FamilyMeasurements = "measurements"
+)
+
+//go:embed v1/*.json v1/*.proto
+var files embed.FS
+
+// ProtoName is the Protobuf definition of the binary measurement encoding.
+const ProtoName = Version + "/measurement.proto"
+
+var fileNames = map[string]string{
+	FamilyStations:     "station.json",
+	FamilyClusters:     "cluster.json",
+	FamilyMeasurements: "measurement.json",
+}
+
+// Families returns the topic families a schema exists for.
+func Families() []string {
+	families := make([]string, 0, len(fileNames))
+	for family := range fileNames {
+		families = append(families, family)
+	}
+	sort.Strings(families)
+	return families
+}
+
+// Name returns the versioned schema name of family, e.g. "v1/station.json".
+func Name(family string) string {
+	return Version + "/" + fileNames[family]
+}
+
+// Schema returns the raw JSON Schema document of family.
+func Schema(family string) ([]byte, error) {
+	if _, exists := fileNames[family]; !exists {
+		return nil, fmt.Errorf("no schema for topic family %q", family)
+	}
+	return files.ReadFile(Name(family))
+}
+
+// Proto returns the Protobuf definition of the binary measurement encoding.
+func Proto() ([]byte, error) {
+	return files.ReadFile(ProtoName)
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a payload that violates its schema.
+type ValidationError struct {
+	Family string       `json:"family"`
+	Schema string       `json:"schema"`
+	Fields []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, field := range e.Fields {
+		messages[i] = field.Field + ": " + field.Message
+	}
+	return fmt.Sprintf("payload does not match %s: %s", e.Schema, strings.Join(messages, "; "))
+}
+
+type Validator struct {
+	schemas map[string]*jsonschema.Schema
+}
+
+func NewValidator() (*Validator, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft7
+
+	validator := &Validator{schemas: make(map[string]*jsonschema.Schema)}
+
+	for family := range fileNames {
+		document, err := Schema(family)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := compiler.AddResource(Name(family), bytes.NewReader(document)); err != nil {
+			return nil, fmt.Errorf("failed to load schema %s: %w", Name(family), err)
+		}
+
+		schema, err := compiler.Compile(Name(family))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile schema %s: %w", Name(family), err)
+		}
+		validator.schemas[family] = schema
+	}
+
+	return validator, nil
+}
+
+// Validate checks data against the schema of family. Families without a
+// schema are accepted as they are.
+func (v *Validator) Validate(family string, data []byte) error {
+	schema, exists := v.schemas[family]
+	if !exists {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return &ValidationError{
+			Family: family,
+			Schema: Name(family),
+			Fields: []FieldError{{Field: "/", Message: err.Error()}},
+		}
+	}
+
+	err := schema.Validate(document)
+	if err == nil {
+		return nil
+	}
+
+	var schemaErr *jsonschema.ValidationError
+	if !errors.As(err, &schemaErr) {
+		return err
+	}
+
+	return &ValidationError{
+		Family: family,
+		Schema: Name(family),
+		Fields: fieldErrors(schemaErr),
+	}
+}
+
+// fieldErrors flattens the error tree to the leaf errors, which point at the
+// offending fields.
+func fieldErrors(err *jsonschema.ValidationError) []FieldError {
+	if len(err.Causes) == 0 {
+		field := err.InstanceLocation
+		if field == "" {
+			field = "/"
+		}
+		return []FieldError{{Field: field, Message: err.Message}}
+	}
+
+	var fields []FieldError
+	for _, cause := range err.Causes {
+		fields = append(fields, fieldErrors(cause)...)
+	}
+	return fields
+}
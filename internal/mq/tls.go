@@ -0,0 +1,44 @@
+package mq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gps-no-sync/internal/config/components"
+	"os"
+)
+
+func newTLSConfig(cfg *components.MQTTConfigImpl) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
+		InsecureSkipVerify: cfg.TLSInsecureSkip,
+	}
+
+	if cfg.TLSCAFile != "" {
+		caBundle, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle %s: %w", cfg.TLSCAFile, err)
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no valid certificates found in CA bundle %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, fmt.Errorf("client certificate and key must be configured together")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
@@ -3,6 +3,7 @@ package mq
 import (
 	"fmt"
 	"github.com/rs/zerolog"
+	"gps-no-sync/internal/interfaces"
 	"regexp"
 	"strings"
 )
@@ -23,6 +24,27 @@ const (
 	StationTopicTemplate     = "%s/v1/stations/+"
 	MeasurementTopicTemplate = "%s/v1/measurements/+"
 	ClusterTopicTemplate     = "%s/v1/clusters/+"
+
+	// ClusterRequestTopicTemplate carries membership changes of clusters. The
+	// broker must only let the commissioning client publish to it, as requests
+	// on it are applied without further authorisation.
+	ClusterRequestTopicTemplate = "%s/v1/cluster-requests/+"
+
+	// MeasurementEncodingTopicTemplate carries measurements in a compact binary
+	// encoding, e.g. gps-no/v1/measurements/{id}/cbor.
+	MeasurementEncodingTopicTemplate = "%s/v1/measurements/+/%s"
+
+	ErrorTopicTemplate    = "%s/v1/%s/%s/errors"
+	ConflictTopicTemplate = "%s/v1/%s/%s/conflicts"
+	ReportTopicTemplate   = "%s/v1/%s/%s/reports"
+
+	StationPatchTopicTemplate   = "%s/v1/stations/+/patch"
+	HeartbeatTopicTemplate      = "%s/v1/stations/+/heartbeat"
+	StationStatusTopicTemplate  = "%s/v1/stations/%s/status"
+	StationCommandTopicTemplate = "%s/v1/stations/%s/cmd"
+	CommandAckTopicTemplate     = "%s/v1/stations/+/cmd/ack"
+
+	SharedSubscriptionTemplate = "$share/%s/%s"
 )
 
 func (m *TopicManager) GetStationTopic() string {
@@ -33,10 +55,89 @@ func (m *TopicManager) GetMeasurementTopic() string {
 	return fmt.Sprintf(MeasurementTopicTemplate, m.BaseTopic)
 }
 
+// GetMeasurementSubscription returns the measurement topic filter, prefixed as
+// a shared subscription when a share group is configured so that the broker
+// distributes measurements across all replicas instead of duplicating them.
+func (m *TopicManager) GetMeasurementSubscription(shareGroup string) string {
+	return sharedSubscription(shareGroup, m.GetMeasurementTopic())
+}
+
+func (m *TopicManager) GetMeasurementEncodingTopic(encoding string) string {
+	return fmt.Sprintf(MeasurementEncodingTopicTemplate, m.BaseTopic, encoding)
+}
+
+// GetMeasurementEncodingSubscription is GetMeasurementSubscription for the
+// topic of a binary encoding.
+func (m *TopicManager) GetMeasurementEncodingSubscription(shareGroup, encoding string) string {
+	return sharedSubscription(shareGroup, m.GetMeasurementEncodingTopic(encoding))
+}
+
+func sharedSubscription(shareGroup, topic string) string {
+	if shareGroup == "" {
+		return topic
+	}
+	return fmt.Sprintf(SharedSubscriptionTemplate, shareGroup, topic)
+}
+
 func (m *TopicManager) GetClusterTopic() string {
 	return fmt.Sprintf(ClusterTopicTemplate, m.BaseTopic)
 }
 
+func (m *TopicManager) GetClusterRequestTopic() string {
+	return fmt.Sprintf(ClusterRequestTopicTemplate, m.BaseTopic)
+}
+
+// GetErrorTopic returns the topic validation errors for a single device of a
+// topic family are reported on.
+func (m *TopicManager) GetErrorTopic(family, id string) string {
+	return fmt.Sprintf(ErrorTopicTemplate, m.GetBaseTopic(), family, id)
+}
+
+// GetStationPatchTopic returns the filter of the topics stations publish merge
+// patches of their state to.
+func (m *TopicManager) GetStationPatchTopic() string {
+	return fmt.Sprintf(StationPatchTopicTemplate, m.GetBaseTopic())
+}
+
+func (m *TopicManager) GetHeartbeatTopic() string {
+	return fmt.Sprintf(HeartbeatTopicTemplate, m.GetBaseTopic())
+}
+
+// GetHeartbeatSubscription is GetMeasurementSubscription for heartbeats, which
+// every replica handles the same way.
+func (m *TopicManager) GetHeartbeatSubscription(shareGroup string) string {
+	return sharedSubscription(shareGroup, m.GetHeartbeatTopic())
+}
+
+// GetStationStatusTopic returns the topic the liveness of the station
+// published on topic id stationTopic is retained on.
+func (m *TopicManager) GetStationStatusTopic(stationTopic string) string {
+	return fmt.Sprintf(StationStatusTopicTemplate, m.GetBaseTopic(), stationTopic)
+}
+
+// GetStationCommandTopic returns the topic commands for the station published
+// on topic id stationTopic are sent to.
+func (m *TopicManager) GetStationCommandTopic(stationTopic string) string {
+	return fmt.Sprintf(StationCommandTopicTemplate, m.GetBaseTopic(), stationTopic)
+}
+
+func (m *TopicManager) GetCommandAckTopic() string {
+	return fmt.Sprintf(CommandAckTopicTemplate, m.GetBaseTopic())
+}
+
+// GetConflictTopic returns the topic rejected updates of a single device or
+// cluster are reported on when the update carried no MQTT 5 response topic.
+func (m *TopicManager) GetConflictTopic(family, id string) string {
+	return fmt.Sprintf(ConflictTopicTemplate, m.GetBaseTopic(), family, id)
+}
+
+// GetReportTopic returns the topic the outcome of a change requested for a
+// single device or cluster is reported on when the request carried no MQTT 5
+// response topic.
+func (m *TopicManager) GetReportTopic(family, id string) string {
+	return fmt.Sprintf(ReportTopicTemplate, m.GetBaseTopic(), family, id)
+}
+
 func (m *TopicManager) buildTopicRegex(template string) *regexp.Regexp {
 	pattern := strings.ReplaceAll(template, "%s", m.BaseTopic)
 	pattern = strings.ReplaceAll(pattern, "+", "([^/]+)")
@@ -45,30 +146,38 @@ func (m *TopicManager) buildTopicRegex(template string) *regexp.Regexp {
 	return regexp.MustCompile(pattern)
 }
 
-func (m *TopicManager) ExtractIdFromTopic(topic, template string) string {
+func (m *TopicManager) ExtractIdFromTopic(topic, template string) (string, error) {
 	regex := m.buildTopicRegex(template)
 	matches := regex.FindStringSubmatch(topic)
 
-	/*
-		if len(matches) < 2 {
-			return "", fmt.Errorf("could not extract ID from topic: %s", topic)
-		}
-	*/
+	if len(matches) < 2 {
+		return "", fmt.Errorf("could not extract ID from topic: %s", topic)
+	}
 
-	return matches[1]
+	return matches[1], nil
 }
 
-func (m *TopicManager) ExtractStationId(topic string) string {
+func (m *TopicManager) ExtractStationId(topic string) (string, error) {
 	return m.ExtractIdFromTopic(topic, StationTopicTemplate)
 }
 
-func (m *TopicManager) ExtractClusterId(topic string) string {
+func (m *TopicManager) ExtractMeasurementStationId(topic string) string {
+	return TopicID(topic)
+}
+
+func (m *TopicManager) ExtractClusterId(topic string) (string, error) {
 	return m.ExtractIdFromTopic(topic, ClusterTopicTemplate)
 }
 
+func (m *TopicManager) ExtractClusterRequestId(topic string) (string, error) {
+	return m.ExtractIdFromTopic(topic, ClusterRequestTopicTemplate)
+}
+
 func (m *TopicManager) GetBaseTopic() string {
 	if strings.HasSuffix(m.BaseTopic, "/") {
 		return m.BaseTopic[:len(m.BaseTopic)-1]
 	}
 	return m.BaseTopic
 }
+
+var _ interfaces.ITopicManager = (*TopicManager)(nil)
@@ -0,0 +1,43 @@
+package mq
+
+import (
+	"context"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gps-no-sync/internal/config/components"
+	"net/http"
+)
+
+const (
+	ProtocolVersion3 = 3
+	ProtocolVersion5 = 5
+)
+
+// transport hides the differences between the MQTT 3.1.1 and MQTT 5 client
+// libraries. Inbound messages are always delivered as mqtt.Message so handlers
+// do not need to know which protocol version is in use.
+type transport interface {
+	Connect(ctx context.Context) error
+	Disconnect(ctx context.Context)
+	IsConnected() bool
+	Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error
+	Unsubscribe(topic string) error
+	Publish(topic string, payload []byte, options *MessageOptions) error
+}
+
+type transportCallbacks struct {
+	onConnect        func()
+	onConnectionLost func(err error)
+}
+
+type willMessage struct {
+	topic   string
+	payload []byte
+}
+
+func websocketHeaders(cfg *components.MQTTConfigImpl) http.Header {
+	headers := make(http.Header)
+	for name, value := range cfg.WebsocketHeaders {
+		headers.Set(name, value)
+	}
+	return headers
+}
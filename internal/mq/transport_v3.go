@@ -0,0 +1,98 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gps-no-sync/internal/config/components"
+	"net/http"
+)
+
+type v3Transport struct {
+	client mqtt.Client
+}
+
+func newV3Transport(cfg *components.MQTTConfigImpl, clientID string, will *willMessage, callbacks transportCallbacks) (*v3Transport, error) {
+	opts := mqtt.NewClientOptions()
+
+	opts.AddBroker(cfg.Url)
+	opts.SetClientID(clientID)
+
+	if cfg.Username != "" && cfg.Password != "" {
+		opts.SetUsername(cfg.Username)
+		opts.SetPassword(cfg.Password)
+	}
+
+	opts.SetKeepAlive(cfg.KeepAlive)
+	opts.SetAutoReconnect(cfg.AutoReconnect)
+	opts.SetMaxReconnectInterval(cfg.MaxReconnectInterval)
+	opts.SetCleanSession(cfg.CleanSession)
+
+	if will != nil {
+		opts.SetBinaryWill(will.topic, will.payload, 1, true)
+	}
+
+	if cfg.TLSEnabled {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not build TLS configuration: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if len(cfg.WebsocketHeaders) > 0 {
+		opts.SetHTTPHeaders(websocketHeaders(cfg))
+	}
+	opts.SetWebsocketOptions(&mqtt.WebsocketOptions{Proxy: http.ProxyFromEnvironment})
+
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		callbacks.onConnect()
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		callbacks.onConnectionLost(err)
+	})
+
+	return &v3Transport{client: mqtt.NewClient(opts)}, nil
+}
+
+func (t *v3Transport) Connect(ctx context.Context) error {
+	token := t.client.Connect()
+
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *v3Transport) Disconnect(ctx context.Context) {
+	t.client.Disconnect(250)
+}
+
+func (t *v3Transport) IsConnected() bool {
+	return t.client.IsConnected()
+}
+
+func (t *v3Transport) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	token := t.client.Subscribe(topic, qos, handler)
+	token.Wait()
+
+	return token.Error()
+}
+
+func (t *v3Transport) Unsubscribe(topic string) error {
+	token := t.client.Unsubscribe(topic)
+	token.Wait()
+
+	return token.Error()
+}
+
+func (t *v3Transport) Publish(topic string, payload []byte, options *MessageOptions) error {
+	token := t.client.Publish(topic, options.Qos, options.Retained, payload)
+	if !token.WaitTimeout(options.Timeout) {
+		return fmt.Errorf("timed out publishing to topic %s", topic)
+	}
+
+	return token.Error()
+}
@@ -0,0 +1,342 @@
+package mq
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gps-no-sync/internal/config/components"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const v5RequestTimeout = 10 * time.Second
+
+type v5Transport struct {
+	config    autopaho.ClientConfig
+	callbacks transportCallbacks
+
+	mu       sync.RWMutex
+	manager  *autopaho.ConnectionManager
+	cancel   context.CancelFunc
+	handlers map[string]mqtt.MessageHandler
+
+	connected atomic.Bool
+}
+
+func newV5Transport(cfg *components.MQTTConfigImpl, clientID string, will *willMessage, callbacks transportCallbacks) (*v5Transport, error) {
+	serverURL, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url %s: %w", cfg.Url, err)
+	}
+
+	t := &v5Transport{
+		callbacks: callbacks,
+		handlers:  make(map[string]mqtt.MessageHandler),
+	}
+
+	// autopaho always reconnects on its own, MQTT_AUTO_RECONNECT only applies to MQTT 3.
+	backoff := autopaho.NewConstantBackoff(cfg.MaxReconnectInterval)
+	if cfg.MaxReconnectInterval > 2*time.Second {
+		backoff = autopaho.NewExponentialBackoff(time.Second, cfg.MaxReconnectInterval, 2*time.Second, 2)
+	}
+
+	t.config = autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{serverURL},
+		KeepAlive:                     uint16(cfg.KeepAlive.Seconds()),
+		CleanStartOnInitialConnection: cfg.CleanSession,
+		ReconnectBackoff:              backoff,
+		OnConnectionUp: func(manager *autopaho.ConnectionManager, connack *paho.Connack) {
+			t.connected.Store(true)
+			t.callbacks.onConnect()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:          clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){t.route},
+			OnClientError: func(err error) {
+				t.connected.Store(false)
+				t.callbacks.onConnectionLost(err)
+			},
+			OnServerDisconnect: func(disconnect *paho.Disconnect) {
+				t.connected.Store(false)
+				t.callbacks.onConnectionLost(fmt.Errorf("server closed connection with reason code %d", disconnect.ReasonCode))
+			},
+		},
+	}
+
+	if will != nil {
+		t.config.SetWillMessage(will.topic, will.payload, 1, true)
+	}
+
+	if !cfg.CleanSession {
+		t.config.SessionExpiryInterval = uint32(time.Hour.Seconds())
+	}
+
+	if cfg.Username != "" && cfg.Password != "" {
+		t.config.ConnectUsername = cfg.Username
+		t.config.ConnectPassword = []byte(cfg.Password)
+	}
+
+	if cfg.TLSEnabled {
+		tlsConfig, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not build TLS configuration: %w", err)
+		}
+		t.config.TlsCfg = tlsConfig
+	}
+
+	// The default websocket dialer already honours the HTTP(S)_PROXY variables.
+	if len(cfg.WebsocketHeaders) > 0 {
+		headers := websocketHeaders(cfg)
+		t.config.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(*url.URL, *tls.Config) http.Header {
+				return headers.Clone()
+			},
+		}
+	}
+
+	return t, nil
+}
+
+func (t *v5Transport) Connect(ctx context.Context) error {
+	runCtx, cancel := context.WithCancel(context.Background())
+
+	// The manager has to be stored before the connection comes up, as
+	// OnConnectionUp restores the subscriptions through it.
+	t.mu.Lock()
+	manager, err := autopaho.NewConnection(runCtx, t.config)
+	if err != nil {
+		t.mu.Unlock()
+		cancel()
+		return err
+	}
+	t.manager = manager
+	t.cancel = cancel
+	t.mu.Unlock()
+
+	if err := manager.AwaitConnection(ctx); err != nil {
+		t.Disconnect(context.Background())
+		return err
+	}
+
+	return nil
+}
+
+func (t *v5Transport) Disconnect(ctx context.Context) {
+	t.mu.Lock()
+	manager, cancel := t.manager, t.cancel
+	t.manager, t.cancel = nil, nil
+	t.mu.Unlock()
+
+	t.connected.Store(false)
+
+	if manager != nil {
+		_ = manager.Disconnect(ctx)
+	}
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (t *v5Transport) IsConnected() bool {
+	return t.connected.Load()
+}
+
+func (t *v5Transport) Subscribe(topic string, qos byte, handler mqtt.MessageHandler) error {
+	t.mu.Lock()
+	t.handlers[topic] = handler
+	manager := t.manager
+	t.mu.Unlock()
+
+	if manager == nil {
+		return fmt.Errorf("client is not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+
+	suback, err := manager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: qos}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		return fmt.Errorf("broker rejected subscription with reason code %d", suback.Reasons[0])
+	}
+
+	return nil
+}
+
+func (t *v5Transport) Unsubscribe(topic string) error {
+	t.mu.Lock()
+	delete(t.handlers, topic)
+	manager := t.manager
+	t.mu.Unlock()
+
+	if manager == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+
+	_, err := manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	return err
+}
+
+func (t *v5Transport) Publish(topic string, payload []byte, options *MessageOptions) error {
+	t.mu.RLock()
+	manager := t.manager
+	t.mu.RUnlock()
+
+	if manager == nil {
+		return fmt.Errorf("client is not connected")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+
+	_, err := manager.Publish(ctx, &paho.Publish{
+		QoS:        options.Qos,
+		Retain:     options.Retained,
+		Topic:      topic,
+		Payload:    payload,
+		Properties: toPublishProperties(options),
+	})
+
+	return err
+}
+
+func (t *v5Transport) route(received paho.PublishReceived) (bool, error) {
+	message := &v5Message{
+		publish:    received.Packet,
+		properties: fromPublishProperties(received.Packet.Properties),
+	}
+
+	t.mu.RLock()
+	var matched []mqtt.MessageHandler
+	for filter, handler := range t.handlers {
+		if topicMatchesFilter(filter, message.Topic()) {
+			matched = append(matched, handler)
+		}
+	}
+	t.mu.RUnlock()
+
+	for _, handler := range matched {
+		handler(nil, message)
+	}
+
+	return len(matched) > 0, nil
+}
+
+func toPublishProperties(options *MessageOptions) *paho.PublishProperties {
+	properties := &paho.PublishProperties{
+		ContentType:     options.ContentType,
+		ResponseTopic:   options.ResponseTopic,
+		CorrelationData: options.CorrelationData,
+	}
+
+	if options.MessageExpiry > 0 {
+		expiry := uint32(options.MessageExpiry.Seconds())
+		properties.MessageExpiry = &expiry
+	}
+
+	for key, value := range options.UserProperties {
+		properties.User = append(properties.User, paho.UserProperty{Key: key, Value: value})
+	}
+
+	return properties
+}
+
+func fromPublishProperties(properties *paho.PublishProperties) *Properties {
+	result := &Properties{UserProperties: make(map[string]string)}
+	if properties == nil {
+		return result
+	}
+
+	result.ContentType = properties.ContentType
+	result.ResponseTopic = properties.ResponseTopic
+	result.CorrelationData = properties.CorrelationData
+
+	if properties.MessageExpiry != nil {
+		result.MessageExpiry = time.Duration(*properties.MessageExpiry) * time.Second
+	}
+
+	for _, property := range properties.User {
+		result.UserProperties[property.Key] = property.Value
+	}
+
+	return result
+}
+
+// topicMatchesFilter implements MQTT topic filter matching, including the
+// $share/<group>/ prefix of shared subscriptions.
+func topicMatchesFilter(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+type v5Message struct {
+	publish    *paho.Publish
+	properties *Properties
+}
+
+func (m *v5Message) Duplicate() bool {
+	return m.publish.Duplicate()
+}
+
+func (m *v5Message) Qos() byte {
+	return m.publish.QoS
+}
+
+func (m *v5Message) Retained() bool {
+	return m.publish.Retain
+}
+
+func (m *v5Message) Topic() string {
+	return m.publish.Topic
+}
+
+func (m *v5Message) MessageID() uint16 {
+	return m.publish.PacketID
+}
+
+func (m *v5Message) Payload() []byte {
+	return m.publish.Payload
+}
+
+func (m *v5Message) Ack() {}
+
+func (m *v5Message) Properties() *Properties {
+	return m.properties
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clockStepThreshold is the deviation from the estimated offset at which a
+// station clock is considered to have been set (NTP step, reboot) rather than
+// drifted, which discards the previous samples.
+const clockStepThreshold = 10 * time.Second
+
+// ClockEstimate is the estimated clock error of a station: the device clock
+// plus Offset is server time, and the offset grows by DriftPPM microseconds
+// per second.
+type ClockEstimate struct {
+	StationID string        `json:"station_id"`
+	Offset    time.Duration `json:"offset"`
+	DriftPPM  float64       `json:"drift_ppm"`
+	Samples   int           `json:"samples"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+type clockSample struct {
+	at     time.Time
+	offset float64
+}
+
+type stationClock struct {
+	samples    []clockSample
+	next       int
+	intercept  float64
+	slope      float64
+	reference  time.Time
+	reportedAt time.Time
+}
+
+// ClockEstimator estimates the clock offset and drift of every station with a
+// least squares fit over its most recent (receive time, receive time - device
+// time) samples. The offset includes the network latency, which is about the
+// same for all stations and therefore does not affect their alignment.
+type ClockEstimator struct {
+	window         int
+	reportInterval time.Duration
+	skewThreshold  time.Duration
+
+	mu       sync.Mutex
+	stations map[string]*stationClock
+}
+
+func NewClockEstimator(window int, reportInterval, skewThreshold time.Duration) *ClockEstimator {
+	return &ClockEstimator{
+		window:         window,
+		reportInterval: reportInterval,
+		skewThreshold:  skewThreshold,
+		stations:       make(map[string]*stationClock),
+	}
+}
+
+// Observe adds a sample for the device time of a measurement received at
+// receivedAt and returns the updated estimate. report is true when the
+// estimate is due to be recorded again.
+func (e *ClockEstimator) Observe(stationID string, deviceTime, receivedAt time.Time) (ClockEstimate, bool) {
+	if e == nil {
+		return ClockEstimate{}, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	clock, exists := e.stations[stationID]
+	if !exists {
+		clock = &stationClock{samples: make([]clockSample, 0, e.window)}
+		e.stations[stationID] = clock
+	}
+
+	sample := clockSample{at: receivedAt, offset: receivedAt.Sub(deviceTime).Seconds()}
+
+	if len(clock.samples) > 0 {
+		deviation := math.Abs(sample.offset - clock.offsetAt(receivedAt))
+		if deviation > clockStepThreshold.Seconds() {
+			clock.samples = clock.samples[:0]
+			clock.next = 0
+		}
+	}
+
+	if len(clock.samples) < e.window {
+		clock.samples = append(clock.samples, sample)
+	} else {
+		clock.samples[clock.next] = sample
+		clock.next = (clock.next + 1) % e.window
+	}
+	clock.fit(receivedAt)
+
+	report := receivedAt.Sub(clock.reportedAt) >= e.reportInterval
+	if report {
+		clock.reportedAt = receivedAt
+	}
+
+	return clock.estimate(stationID), report
+}
+
+// Correct converts a device timestamp of stationID to server time. Timestamps
+// of stations without samples are returned unchanged.
+func (e *ClockEstimator) Correct(stationID string, deviceTime time.Time) time.Time {
+	if e == nil {
+		return deviceTime
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	clock, exists := e.stations[stationID]
+	if !exists || len(clock.samples) == 0 {
+		return deviceTime
+	}
+
+	// The drift is small enough to evaluate the fit at the device time.
+	offset := clock.offsetAt(deviceTime)
+	return deviceTime.Add(time.Duration(offset * float64(time.Second)))
+}
+
+// IsSkewed reports whether the offset of estimate exceeds the configured
+// threshold, which usually means NTP is not working on the station.
+func (e *ClockEstimator) IsSkewed(estimate ClockEstimate) bool {
+	if e == nil {
+		return false
+	}
+
+	offset := estimate.Offset
+	if offset < 0 {
+		offset = -offset
+	}
+	return offset > e.skewThreshold
+}
+
+// Estimates returns the current estimate of every station, sorted by station id.
+func (e *ClockEstimator) Estimates() []ClockEstimate {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	estimates := make([]ClockEstimate, 0, len(e.stations))
+	for stationID, clock := range e.stations {
+		estimates = append(estimates, clock.estimate(stationID))
+	}
+
+	sort.Slice(estimates, func(i, j int) bool {
+		return estimates[i].StationID < estimates[j].StationID
+	})
+	return estimates
+}
+
+func (c *stationClock) offsetAt(at time.Time) float64 {
+	return c.intercept + c.slope*at.Sub(c.reference).Seconds()
+}
+
+// fit computes offset = intercept + slope * (t - reference) over all samples.
+func (c *stationClock) fit(reference time.Time) {
+	c.reference = reference
+
+	n := float64(len(c.samples))
+	var sumX, sumY, sumXX, sumXY float64
+	for _, sample := range c.samples {
+		x := sample.at.Sub(reference).Seconds()
+		sumX += x
+		sumY += sample.offset
+		sumXX += x * x
+		sumXY += x * sample.offset
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if len(c.samples) < 2 || denominator == 0 {
+		c.slope = 0
+		c.intercept = sumY / n
+		return
+	}
+
+	c.slope = (n*sumXY - sumX*sumY) / denominator
+	c.intercept = (sumY - c.slope*sumX) / n
+}
+
+func (c *stationClock) estimate(stationID string) ClockEstimate {
+	return ClockEstimate{
+		StationID: stationID,
+		Offset:    time.Duration(c.intercept * float64(time.Second)),
+		DriftPPM:  c.slope * 1e6,
+		Samples:   len(c.samples),
+		UpdatedAt: c.reference,
+	}
+}
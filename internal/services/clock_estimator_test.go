@@ -0,0 +1,187 @@
+package services
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type clockObservation struct {
+	after  time.Duration
+	offset time.Duration
+}
+
+func TestClockEstimatorObserve(t *testing.T) {
+	// offsets returns a sample every 10 seconds whose offset grows by driftPPM.
+	offsets := func(count int, offset time.Duration, driftPPM float64) []clockObservation {
+		observations := make([]clockObservation, count)
+		for i := range observations {
+			after := time.Duration(i) * 10 * time.Second
+			drift := time.Duration(after.Seconds() * driftPPM * float64(time.Microsecond))
+			observations[i] = clockObservation{after: after, offset: offset + drift}
+		}
+		return observations
+	}
+
+	tests := []struct {
+		name         string
+		window       int
+		observations []clockObservation
+		wantOffset   time.Duration
+		wantDriftPPM float64
+		wantSamples  int
+	}{
+		{
+			name:         "single sample",
+			window:       10,
+			observations: offsets(1, 2*time.Second, 0),
+			wantOffset:   2 * time.Second,
+			wantSamples:  1,
+		},
+		{
+			name:         "constant offset",
+			window:       10,
+			observations: offsets(5, -3*time.Second, 0),
+			wantOffset:   -3 * time.Second,
+			wantSamples:  5,
+		},
+		{
+			name:         "drifting clock",
+			window:       10,
+			observations: offsets(10, time.Second, 50),
+			wantOffset:   time.Second + 90*50*time.Microsecond,
+			wantDriftPPM: 50,
+			wantSamples:  10,
+		},
+		{
+			name:         "window keeps most recent samples",
+			window:       3,
+			observations: offsets(8, time.Second, -20),
+			wantOffset:   time.Second - 70*20*time.Microsecond,
+			wantDriftPPM: -20,
+			wantSamples:  3,
+		},
+		{
+			name:   "step discards previous samples",
+			window: 10,
+			observations: append(offsets(5, time.Second, 0),
+				clockObservation{after: 50 * time.Second, offset: time.Minute},
+				clockObservation{after: 60 * time.Second, offset: time.Minute},
+			),
+			wantOffset:  time.Minute,
+			wantSamples: 2,
+		},
+		{
+			name:   "deviation below the step threshold is kept",
+			window: 10,
+			observations: []clockObservation{
+				{after: 0, offset: time.Second},
+				{after: 10 * time.Second, offset: 5 * time.Second},
+			},
+			wantOffset:   5 * time.Second,
+			wantDriftPPM: 400000,
+			wantSamples:  2,
+		},
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewClockEstimator(tt.window, time.Minute, time.Second)
+
+			var estimate ClockEstimate
+			for _, observation := range tt.observations {
+				receivedAt := start.Add(observation.after)
+				estimate, _ = e.Observe("a1", receivedAt.Add(-observation.offset), receivedAt)
+			}
+
+			if diff := estimate.Offset - tt.wantOffset; diff.Abs() > time.Microsecond {
+				t.Errorf("offset = %v, want %v", estimate.Offset, tt.wantOffset)
+			}
+			if math.Abs(estimate.DriftPPM-tt.wantDriftPPM) > 0.01 {
+				t.Errorf("drift = %f ppm, want %f ppm", estimate.DriftPPM, tt.wantDriftPPM)
+			}
+			if estimate.Samples != tt.wantSamples {
+				t.Errorf("samples = %d, want %d", estimate.Samples, tt.wantSamples)
+			}
+		})
+	}
+}
+
+func TestClockEstimatorReportInterval(t *testing.T) {
+	e := NewClockEstimator(10, time.Minute, time.Second)
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		after      time.Duration
+		wantReport bool
+	}{
+		{after: 0, wantReport: true},
+		{after: 30 * time.Second, wantReport: false},
+		{after: 59 * time.Second, wantReport: false},
+		{after: 60 * time.Second, wantReport: true},
+		{after: 90 * time.Second, wantReport: false},
+	}
+
+	for _, tt := range tests {
+		receivedAt := start.Add(tt.after)
+		if _, report := e.Observe("a1", receivedAt, receivedAt); report != tt.wantReport {
+			t.Errorf("report after %v = %v, want %v", tt.after, report, tt.wantReport)
+		}
+	}
+}
+
+func TestClockEstimatorCorrect(t *testing.T) {
+	e := NewClockEstimator(10, time.Minute, time.Second)
+	receivedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	e.Observe("a1", receivedAt.Add(-2*time.Second), receivedAt)
+
+	tests := []struct {
+		name       string
+		stationID  string
+		deviceTime time.Time
+		want       time.Time
+	}{
+		{
+			name:       "known station is shifted by its offset",
+			stationID:  "a1",
+			deviceTime: receivedAt,
+			want:       receivedAt.Add(2 * time.Second),
+		},
+		{
+			name:       "unknown station is unchanged",
+			stationID:  "b2",
+			deviceTime: receivedAt,
+			want:       receivedAt,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.Correct(tt.stationID, tt.deviceTime); !got.Equal(tt.want) {
+				t.Errorf("Correct = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockEstimatorIsSkewed(t *testing.T) {
+	e := NewClockEstimator(10, time.Minute, time.Second)
+
+	tests := []struct {
+		offset time.Duration
+		want   bool
+	}{
+		{offset: 0, want: false},
+		{offset: time.Second, want: false},
+		{offset: 1500 * time.Millisecond, want: true},
+		{offset: -1500 * time.Millisecond, want: true},
+		{offset: -500 * time.Millisecond, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := e.IsSkewed(ClockEstimate{Offset: tt.offset}); got != tt.want {
+			t.Errorf("IsSkewed(%v) = %v, want %v", tt.offset, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gps-no-sync/internal/models"
+	"gps-no-sync/internal/mq"
+	"time"
+)
+
+const (
+	ClusterCreationDisabled   = "disabled"
+	ClusterCreationAuthorized = "authorized"
+	ClusterCreationOpen       = "open"
+)
+
+var ErrClusterNameTaken = errors.New("cluster name already taken")
+
+// ClusterConflict is reported to the sender of a cluster that could not be
+// created because another cluster already has its name.
+type ClusterConflict struct {
+	Topic         string    `json:"topic"`
+	Name          string    `json:"name"`
+	ExistingTopic string    `json:"existing_topic,omitempty"`
+	Reason        string    `json:"reason"`
+	DetectedAt    time.Time `json:"detected_at"`
+}
+
+type ClusterConflictError struct {
+	Conflict ClusterConflict
+}
+
+func (e *ClusterConflictError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrClusterNameTaken, e.Conflict.Name)
+}
+
+func (e *ClusterConflictError) Unwrap() error {
+	return ErrClusterNameTaken
+}
+
+// mayCreate reports whether the creation policy lets a client create clusters.
+// authorized is set for requests on the cluster request topic.
+func (c *ClusterService) mayCreate(authorized bool) bool {
+	switch c.creationPolicy {
+	case ClusterCreationOpen:
+		return true
+	case ClusterCreationAuthorized:
+		return authorized
+	default:
+		return false
+	}
+}
+
+// createCluster creates the cluster named by clusterMessage and assigns the
+// listed stations to it, in one transaction. Only authorised requests may take
+// stations out of other clusters, as documents on the cluster topic could
+// otherwise change the members of any cluster. A name taken by another cluster
+// returns a *ClusterConflictError.
+func (c *ClusterService) createCluster(ctx context.Context, clusterMessage *mq.ClusterMessage, authorized bool) (*MembershipReport, error) {
+	report := &MembershipReport{Cluster: clusterMessage.Topic}
+	var macAddresses []string
+	if clusterMessage.Data.Stations != nil {
+		macAddresses = memberMacAddresses(*clusterMessage.Data.Stations)
+	}
+
+	cluster := &models.Cluster{
+		Name:        clusterMessage.Data.Name,
+		Description: clusterMessage.Data.Description,
+		Topic:       clusterMessage.Topic,
+	}
+
+	err := c.clusterRepository.CreateWithMembers(ctx, cluster, macAddresses, membershipCheck(cluster, macAddresses, authorized, report))
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		conflict := ClusterConflict{
+			Topic:      clusterMessage.Topic,
+			Name:       cluster.Name,
+			Reason:     fmt.Sprintf("a cluster named %q already exists", cluster.Name),
+			DetectedAt: time.Now().UTC(),
+		}
+		if existing, err := c.clusterRepository.FindByName(ctx, cluster.Name); err == nil {
+			conflict.ExistingTopic = clusterTopicID(existing)
+		}
+
+		c.logger.Warn().
+			Str("cluster", clusterMessage.Topic).
+			Str("name", cluster.Name).
+			Str("existing_topic", conflict.ExistingTopic).
+			Msg("Rejected cluster with taken name")
+
+		if err := c.Repair(ctx, clusterMessage.Topic); err != nil {
+			c.logger.Error().Err(err).
+				Str("cluster", clusterMessage.Topic).
+				Msg("Failed to clear rejected cluster")
+		}
+		return nil, &ClusterConflictError{Conflict: conflict}
+	} else if errors.Is(err, ErrUnknownMembers) {
+		report.Error = err.Error()
+		return report, c.Repair(ctx, clusterMessage.Topic)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create cluster: %w", err)
+	}
+
+	report.Created = true
+	report.Applied = true
+
+	c.logger.Info().
+		Str("cluster", clusterMessage.Topic).
+		Str("name", cluster.Name).
+		Strs("stations", report.Stations).
+		Strs("rejected", report.Rejected).
+		Msg("Created cluster")
+
+	return report, c.syncStored(ctx, clusterMessage.Topic)
+}
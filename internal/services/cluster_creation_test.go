@@ -0,0 +1,27 @@
+package services
+
+import "testing"
+
+func TestClusterServiceMayCreate(t *testing.T) {
+	tests := []struct {
+		policy     string
+		authorized bool
+		want       bool
+	}{
+		{policy: ClusterCreationDisabled, authorized: false, want: false},
+		{policy: ClusterCreationDisabled, authorized: true, want: false},
+		{policy: ClusterCreationAuthorized, authorized: false, want: false},
+		{policy: ClusterCreationAuthorized, authorized: true, want: true},
+		{policy: ClusterCreationOpen, authorized: false, want: true},
+		{policy: ClusterCreationOpen, authorized: true, want: true},
+		{policy: "", authorized: true, want: false},
+		{policy: "unknown", authorized: true, want: false},
+	}
+
+	for _, tt := range tests {
+		service := &ClusterService{creationPolicy: tt.policy}
+		if got := service.mayCreate(tt.authorized); got != tt.want {
+			t.Errorf("mayCreate(%v) with policy %q = %v, want %v", tt.authorized, tt.policy, got, tt.want)
+		}
+	}
+}
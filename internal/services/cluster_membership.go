@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gps-no-sync/internal/models"
+	"gps-no-sync/internal/mq"
+	"slices"
+)
+
+var (
+	ErrCredentialOnClusterTopic = errors.New("credentials must not be sent on the cluster topic, request changes on the cluster request topic")
+	ErrUnknownMembers           = errors.New("unknown or unapproved stations")
+)
+
+// MembershipReport is sent back to the client that requested a change of the
+// stations of a cluster.
+type MembershipReport struct {
+	Cluster string `json:"cluster"`
+	Created bool   `json:"created,omitempty"`
+	Applied bool   `json:"applied"`
+	// Stations is the membership after the request, in canonical form.
+	Stations []string `json:"stations,omitempty"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	// MovedFrom maps stations taken out of another cluster to its id.
+	MovedFrom map[string]uint `json:"moved_from,omitempty"`
+	Unknown   []string        `json:"unknown,omitempty"`
+	// Rejected lists stations of other clusters the client may not move.
+	Rejected []string `json:"rejected,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// applyMembership makes the stations listed in clusterMessage the members of
+// the cluster. Unknown and unapproved stations reject the whole request, and a
+// document without stations leaves the members unchanged.
+func (c *ClusterService) applyMembership(ctx context.Context, cluster *models.Cluster, clusterMessage *mq.ClusterMessage) (*MembershipReport, error) {
+	report := &MembershipReport{Cluster: clusterMessage.Topic}
+	if clusterMessage.Data.Stations == nil {
+		report.Applied = true
+		report.Stations = *cluster.ToDto().Stations
+		return report, c.SyncToMqtt(ctx, cluster)
+	}
+	macAddresses := memberMacAddresses(*clusterMessage.Data.Stations)
+
+	err := c.clusterRepository.UpdateMembers(ctx, cluster.ID, macAddresses, membershipCheck(cluster, macAddresses, true, report))
+	if errors.Is(err, ErrUnknownMembers) {
+		report.Error = err.Error()
+		return report, c.SyncToMqtt(ctx, cluster)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to update cluster members: %w", err)
+	}
+
+	report.Applied = true
+
+	c.logger.Info().
+		Str("cluster", clusterMessage.Topic).
+		Strs("added", report.Added).
+		Strs("removed", report.Removed).
+		Msg("Updated cluster members")
+
+	return report, c.syncStored(ctx, clusterMessage.Topic)
+}
+
+// syncStored publishes the stored state of the cluster on topic id right away.
+// The station listener republishes it once more for every moved station.
+func (c *ClusterService) syncStored(ctx context.Context, topicID string) error {
+	cluster, err := c.clusterRepository.FindByTopic(ctx, topicID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return c.SyncToMqtt(ctx, cluster)
+}
+
+// memberMacAddresses normalises the requested members and drops duplicates.
+func memberMacAddresses(stations []string) []string {
+	macAddresses := make([]string, 0, len(stations))
+	for _, macAddress := range stations {
+		macAddress = normalizeMacAddress(macAddress)
+		if !slices.Contains(macAddresses, macAddress) {
+			macAddresses = append(macAddresses, macAddress)
+		}
+	}
+	return macAddresses
+}
+
+// membershipCheck returns the check passed to the repository, which fills
+// report with the changes and rejects unknown and unapproved stations. Unless
+// allowMoves is set, stations of other clusters are not assigned but reported
+// as rejected.
+func membershipCheck(cluster *models.Cluster, macAddresses []string, allowMoves bool, report *MembershipReport) func(members, requested []models.Station) ([]models.Station, error) {
+	return func(members, requested []models.Station) ([]models.Station, error) {
+		stations := make(map[string]models.Station, len(requested))
+		for _, station := range requested {
+			stations[station.MacAddress] = station
+		}
+
+		for _, macAddress := range macAddresses {
+			if station, found := stations[macAddress]; !found || !station.IsApproved() {
+				report.Unknown = append(report.Unknown, macAddress)
+			}
+		}
+		if len(report.Unknown) > 0 {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownMembers, report.Unknown)
+		}
+
+		assigned := make([]models.Station, 0, len(requested))
+		for _, station := range requested {
+			if station.ClusterID != nil && *station.ClusterID == cluster.ID {
+				assigned = append(assigned, station)
+				continue
+			}
+
+			if station.ClusterID != nil && !allowMoves {
+				report.Rejected = append(report.Rejected, station.MacAddress)
+				delete(stations, station.MacAddress)
+				continue
+			}
+
+			assigned = append(assigned, station)
+			report.Added = append(report.Added, station.MacAddress)
+			if station.ClusterID != nil {
+				if report.MovedFrom == nil {
+					report.MovedFrom = make(map[string]uint)
+				}
+				report.MovedFrom[station.MacAddress] = *station.ClusterID
+			}
+		}
+
+		for _, member := range members {
+			if _, stays := stations[member.MacAddress]; !stays {
+				report.Removed = append(report.Removed, member.MacAddress)
+			}
+		}
+
+		report.Stations = make([]string, len(assigned))
+		for i, station := range assigned {
+			report.Stations[i] = station.MacAddress
+		}
+
+		return assigned, nil
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"gps-no-sync/internal/models"
+	"reflect"
+	"testing"
+)
+
+func TestMembershipCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		members      []models.Station
+		macAddresses []string
+		requested    []models.Station
+		allowMoves   bool
+		want         MembershipReport
+		wantErr      bool
+	}{
+		{
+			name:         "unchanged members",
+			members:      []models.Station{member("a", 1), member("b", 1)},
+			macAddresses: []string{"a", "b"},
+			requested:    []models.Station{member("a", 1), member("b", 1)},
+			want:         MembershipReport{Stations: []string{"a", "b"}},
+		},
+		{
+			name:         "added and removed stations",
+			members:      []models.Station{member("a", 1), member("b", 1)},
+			macAddresses: []string{"b", "c"},
+			requested:    []models.Station{member("b", 1), member("c", 0)},
+			want:         MembershipReport{Stations: []string{"b", "c"}, Added: []string{"c"}, Removed: []string{"a"}},
+		},
+		{
+			name:         "empty request removes all members",
+			members:      []models.Station{member("a", 1), member("b", 1)},
+			macAddresses: []string{},
+			want:         MembershipReport{Stations: []string{}, Removed: []string{"a", "b"}},
+		},
+		{
+			name:         "station of another cluster is moved",
+			members:      []models.Station{member("a", 1)},
+			macAddresses: []string{"a", "d"},
+			requested:    []models.Station{member("a", 1), member("d", 2)},
+			allowMoves:   true,
+			want:         MembershipReport{Stations: []string{"a", "d"}, Added: []string{"d"}, MovedFrom: map[string]uint{"d": 2}},
+		},
+		{
+			name:         "station of another cluster is rejected without moves",
+			members:      []models.Station{member("a", 1)},
+			macAddresses: []string{"a", "d"},
+			requested:    []models.Station{member("a", 1), member("d", 2)},
+			want:         MembershipReport{Stations: []string{"a"}, Rejected: []string{"d"}},
+		},
+		{
+			name:         "unknown station rejects the request",
+			members:      []models.Station{member("a", 1)},
+			macAddresses: []string{"a", "x"},
+			requested:    []models.Station{member("a", 1)},
+			allowMoves:   true,
+			want:         MembershipReport{Unknown: []string{"x"}},
+			wantErr:      true,
+		},
+		{
+			name:         "unapproved station rejects the request",
+			macAddresses: []string{"p"},
+			requested:    []models.Station{{MacAddress: "p", ProvisioningStatus: models.ProvisioningPending}},
+			allowMoves:   true,
+			want:         MembershipReport{Unknown: []string{"p"}},
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &models.Cluster{ID: 1}
+			report := &MembershipReport{}
+
+			assigned, err := membershipCheck(cluster, tt.macAddresses, tt.allowMoves, report)(tt.members, tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnknownMembers) {
+				t.Errorf("error %v does not wrap ErrUnknownMembers", err)
+			}
+			if !reflect.DeepEqual(*report, tt.want) {
+				t.Errorf("report = %+v, want %+v", *report, tt.want)
+			}
+
+			assignedMacAddresses := make([]string, 0, len(assigned))
+			for _, station := range assigned {
+				assignedMacAddresses = append(assignedMacAddresses, station.MacAddress)
+			}
+			if err == nil && !reflect.DeepEqual(assignedMacAddresses, tt.want.Stations) {
+				t.Errorf("assigned = %v, want %v", assignedMacAddresses, tt.want.Stations)
+			}
+		})
+	}
+}
+
+func TestMemberMacAddresses(t *testing.T) {
+	got := memberMacAddresses([]string{"AA-BB-CC-DD-EE-01", "aa:bb:cc:dd:ee:02", "aabb.ccdd.ee01"})
+	want := []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("memberMacAddresses = %v, want %v", got, want)
+	}
+}
+
+// member returns an approved station assigned to clusterID, or to no cluster
+// when clusterID is 0.
+func member(macAddress string, clusterID uint) models.Station {
+	station := models.Station{MacAddress: macAddress, ProvisioningStatus: models.ProvisioningApproved}
+	if clusterID != 0 {
+		station.ClusterID = &clusterID
+	}
+	return station
+}
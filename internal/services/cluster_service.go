@@ -2,11 +2,14 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog"
+	"gorm.io/gorm"
 	"gps-no-sync/internal/database/postgres/repositories"
 	"gps-no-sync/internal/models"
 	"gps-no-sync/internal/mq"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -16,20 +19,24 @@ type ClusterService struct {
 	client            *mq.Client
 	topicManager      *mq.TopicManager
 	logger            zerolog.Logger
+	creationPolicy    string
 }
 
-func NewClusterService(clusterRepository *repositories.ClusterRepository, client *mq.Client, topicManager *mq.TopicManager, logger zerolog.Logger) *ClusterService {
+// NewClusterService creates the service. creationPolicy decides who may create
+// clusters.
+func NewClusterService(clusterRepository *repositories.ClusterRepository, client *mq.Client, topicManager *mq.TopicManager, logger zerolog.Logger, creationPolicy string) *ClusterService {
 	return &ClusterService{
 		clusterRepository: clusterRepository,
 		client:            client,
 		topicManager:      topicManager,
 		logger:            logger,
+		creationPolicy:    creationPolicy,
 	}
 }
 
 func (c *ClusterService) SyncToMqtt(ctx context.Context, cluster *models.Cluster) error {
 	clusterTopic := c.topicManager.GetClusterTopic()
-	targetTopic := strings.Replace(clusterTopic, "+", strconv.Itoa(int(cluster.ID)), 1)
+	targetTopic := strings.Replace(clusterTopic, "+", clusterTopicID(cluster), 1)
 
 	if cluster.DeletedAt != nil {
 		if err := c.client.Publish(targetTopic, nil); err != nil {
@@ -40,7 +47,7 @@ func (c *ClusterService) SyncToMqtt(ctx context.Context, cluster *models.Cluster
 	} else {
 		clusterDto := cluster.ToDto()
 
-		if err := c.client.PublishJson(targetTopic, clusterDto); err != nil {
+		if err := c.client.PublishJsonContext(ctx, targetTopic, clusterDto); err != nil {
 			c.logger.Error().Err(err).
 				Str("topic", targetTopic).
 				Msg("Failed to publish cluster data to MQTTConfig")
@@ -50,6 +57,28 @@ func (c *ClusterService) SyncToMqtt(ctx context.Context, cluster *models.Cluster
 	return nil
 }
 
+// matchesCluster reports whether clusterDto is the published state of cluster,
+// ignoring the order of the stations.
+func matchesCluster(cluster *models.Cluster, clusterDto *models.ClusterDto) bool {
+	if clusterDto.Name != cluster.Name || clusterDto.Description != cluster.Description || clusterDto.Stations == nil {
+		return false
+	}
+
+	stations := slices.Clone(*clusterDto.Stations)
+	published := *cluster.ToDto().Stations
+	slices.Sort(stations)
+	slices.Sort(published)
+	return slices.Equal(stations, published)
+}
+
+// clusterTopicID returns the topic id of cluster, which defaults to its id.
+func clusterTopicID(cluster *models.Cluster) string {
+	if cluster.Topic != "" {
+		return cluster.Topic
+	}
+	return strconv.Itoa(int(cluster.ID))
+}
+
 func (c *ClusterService) SyncAll(ctx context.Context) error {
 	cluster, err := c.clusterRepository.FindAllWhereStationDeletedAtIsNull(ctx)
 	if err != nil {
@@ -72,34 +101,89 @@ func (c *ClusterService) SyncAll(ctx context.Context) error {
 	return nil
 }
 
-func (c *ClusterService) ProcessMessage(ctx context.Context, clusterMessage *mq.ClusterMessage) {
-	if clusterMessage.Source == "SYNC" {
-		return
+// ProcessMessage answers a cluster document published on the cluster topic.
+// Devices read that topic, so documents on it never change the members of a
+// cluster: documents for unknown clusters create it if the creation policy is
+// open, and all others are replaced by the stored state. Documents carrying a
+// credential are rejected, membership changes are requested on the cluster
+// request topic, see ProcessRequest. The returned report is meant for the
+// client and is nil when the client does not need an answer. A name taken by
+// another cluster returns a *ClusterConflictError.
+func (c *ClusterService) ProcessMessage(ctx context.Context, clusterMessage *mq.ClusterMessage) (*MembershipReport, error) {
+	// The origin is set by the publisher and proves nothing, so documents of
+	// other sync instances are handled like device messages. Documents that
+	// match the stored state are not answered, as two instances would otherwise
+	// republish each other's documents until the hop limit.
+	if c.client.IsEcho(clusterMessage.Provenance) {
+		return nil, nil
 	}
+	ctx = mq.WithProvenance(ctx, clusterMessage.Provenance)
 
-	clusterDto := clusterMessage.Data
+	if clusterMessage.HasCredential {
+		c.logger.Warn().
+			Str("cluster", clusterMessage.Topic).
+			Msg("Rejected cluster document carrying a credential on the cluster topic")
 
-	fmt.Println(clusterMessage)
+		report := &MembershipReport{Cluster: clusterMessage.Topic, Error: ErrCredentialOnClusterTopic.Error()}
+		return report, c.Repair(ctx, clusterMessage.Topic)
+	}
 
-	dbCluster, _ := c.clusterRepository.FindByTopic(ctx, clusterMessage.Topic)
-	if dbCluster != nil {
-		err := c.SyncToMqtt(ctx, dbCluster)
-		if err != nil {
-			c.logger.Error().Err(err).
-				Str("cluster_name", clusterDto.Name).
-				Msg("Failed to sync existing cluster to MQTTConfig")
-			return
+	cluster, err := c.clusterRepository.FindByTopic(ctx, clusterMessage.Topic)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if c.mayCreate(false) {
+			return c.createCluster(ctx, clusterMessage, false)
 		}
-	} else {
-		clusterTopic := c.topicManager.GetClusterTopic()
-		targetTopic := strings.Replace(clusterTopic, "+", clusterMessage.Topic, 1)
+		return nil, c.Repair(ctx, clusterMessage.Topic)
+	} else if err != nil {
+		return nil, err
+	}
 
-		if err := c.client.Publish(targetTopic, nil); err != nil {
-			c.logger.Error().Err(err).
-				Str("topic", targetTopic).
-				Msg("Failed to publish")
+	if matchesCluster(cluster, &clusterMessage.Data) {
+		return nil, nil
+	}
+	return nil, c.Repair(ctx, clusterMessage.Topic)
+}
+
+// ProcessRequest applies a membership change requested on the cluster request
+// topic, which only the commissioning client may publish to. The listed
+// stations become the members of the cluster, and unknown clusters are created
+// unless the creation policy is disabled. A name taken by another cluster
+// returns a *ClusterConflictError.
+func (c *ClusterService) ProcessRequest(ctx context.Context, clusterMessage *mq.ClusterMessage) (*MembershipReport, error) {
+	ctx = mq.WithProvenance(ctx, clusterMessage.Provenance)
+
+	cluster, err := c.clusterRepository.FindByTopic(ctx, clusterMessage.Topic)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if c.mayCreate(true) {
+			return c.createCluster(ctx, clusterMessage, true)
 		}
+		return &MembershipReport{Cluster: clusterMessage.Topic, Error: "unknown cluster, creating clusters is disabled"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return c.applyMembership(ctx, cluster, clusterMessage)
+}
+
+// Repair republishes the canonical retained state of the cluster behind the
+// topic id, or a tombstone when no such cluster exists.
+func (c *ClusterService) Repair(ctx context.Context, topicID string) error {
+	dbCluster, err := c.clusterRepository.FindByTopic(ctx, topicID)
+	if err == nil {
+		return c.SyncToMqtt(ctx, dbCluster)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
 	}
+
+	clusterTopic := c.topicManager.GetClusterTopic()
+	targetTopic := strings.Replace(clusterTopic, "+", topicID, 1)
+
+	if err := c.client.Publish(targetTopic, nil); err != nil {
+		return fmt.Errorf("failed to publish cluster tombstone to %s: %w", targetTopic, err)
+	}
+
+	return nil
 }
 
 func (c *ClusterService) ProcessDbCreate(ctx context.Context, cluster *models.Cluster) error {
@@ -165,7 +249,7 @@ func (c *ClusterService) ProcessDbDelete(ctx context.Context, cluster *models.Cl
 		Msg("Processing cluster deletion to MQTTConfig")
 
 	clusterTopic := c.topicManager.GetClusterTopic()
-	targetTopic := strings.Replace(clusterTopic, "+", strconv.Itoa(int(cluster.ID)), 1)
+	targetTopic := strings.Replace(clusterTopic, "+", clusterTopicID(cluster), 1)
 
 	if err := c.client.Publish(targetTopic, nil); err != nil {
 		c.logger.Error().Err(err).
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"gps-no-sync/internal/models"
+	"testing"
+)
+
+func TestMatchesCluster(t *testing.T) {
+	cluster := &models.Cluster{
+		Name:        "hall",
+		Description: "north hall",
+		Stations: []models.Station{
+			{MacAddress: "aa:bb:cc:dd:ee:01"},
+			{MacAddress: "aa:bb:cc:dd:ee:02"},
+		},
+	}
+
+	stations := func(macAddresses ...string) *[]string {
+		return &macAddresses
+	}
+
+	tests := []struct {
+		name       string
+		clusterDto models.ClusterDto
+		want       bool
+	}{
+		{
+			name:       "published state",
+			clusterDto: models.ClusterDto{Name: "hall", Description: "north hall", Stations: stations("aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02")},
+			want:       true,
+		},
+		{
+			name:       "stations in another order",
+			clusterDto: models.ClusterDto{Name: "hall", Description: "north hall", Stations: stations("aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:01")},
+			want:       true,
+		},
+		{
+			name:       "other name",
+			clusterDto: models.ClusterDto{Name: "yard", Description: "north hall", Stations: stations("aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02")},
+		},
+		{
+			name:       "other description",
+			clusterDto: models.ClusterDto{Name: "hall", Stations: stations("aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02")},
+		},
+		{
+			name:       "missing station",
+			clusterDto: models.ClusterDto{Name: "hall", Description: "north hall", Stations: stations("aa:bb:cc:dd:ee:01")},
+		},
+		{
+			name:       "stations left out",
+			clusterDto: models.ClusterDto{Name: "hall", Description: "north hall"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchesCluster(cluster, &tt.clusterDto); got != tt.want {
+				t.Errorf("matchesCluster = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+	"gps-no-sync/internal/config/components"
+	"gps-no-sync/internal/database/postgres/repositories"
+	"gps-no-sync/internal/models"
+	"gps-no-sync/internal/mq"
+	"time"
+)
+
+// commandBatchSize bounds the number of commands sent per poll.
+const commandBatchSize = 100
+
+var (
+	ErrCommandNotFound = errors.New("command not found")
+	ErrUnknownStation  = errors.New("unknown station")
+)
+
+// CommandService sends commands to stations and tracks their acknowledgement.
+// Commands are persisted first and sent by the leader, so they survive
+// restarts and leader changes.
+type CommandService struct {
+	commandRepository *repositories.CommandRepository
+	stationRepository *repositories.StationRepository
+	client            *mq.Client
+	topicManager      *mq.TopicManager
+	config            *components.CommandConfigImpl
+	logger            zerolog.Logger
+}
+
+func NewCommandService(
+	commandRepository *repositories.CommandRepository,
+	stationRepository *repositories.StationRepository,
+	client *mq.Client,
+	topicManager *mq.TopicManager,
+	config *components.CommandConfigImpl,
+	logger zerolog.Logger,
+) *CommandService {
+	return &CommandService{
+		commandRepository: commandRepository,
+		stationRepository: stationRepository,
+		client:            client,
+		topicManager:      topicManager,
+		config:            config,
+		logger:            logger,
+	}
+}
+
+// Issue stores a pending command for the station published on stationTopic.
+// It is sent with the next poll of the leader.
+func (s *CommandService) Issue(ctx context.Context, stationTopic string, name models.CommandName, params map[string]interface{}) (*models.Command, error) {
+	now := time.Now()
+	command := &models.Command{
+		CommandID:     uuid.NewString(),
+		StationTopic:  stationTopic,
+		Name:          name,
+		Params:        params,
+		Status:        models.CommandStatusPending,
+		MaxAttempts:   s.config.MaxAttempts,
+		NextAttemptAt: &now,
+	}
+
+	if err := command.Validate(); err != nil {
+		return nil, err
+	}
+
+	station, err := s.stationRepository.FindByTopic(ctx, stationTopic)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && station.DeletedAt != nil) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStation, stationTopic)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up station: %w", err)
+	} else if !station.IsApproved() {
+		return nil, fmt.Errorf("%w: %s", ErrStationNotApproved, stationTopic)
+	}
+
+	if err := s.commandRepository.Create(ctx, command); err != nil {
+		return nil, fmt.Errorf("failed to store command: %w", err)
+	}
+
+	s.logger.Info().
+		Str("command_id", command.CommandID).
+		Str("station", stationTopic).
+		Str("command", string(name)).
+		Msg("Issued command")
+
+	return command, nil
+}
+
+func (s *CommandService) Get(ctx context.Context, commandID string) (*models.Command, error) {
+	command, err := s.commandRepository.FindByCommandID(ctx, commandID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrCommandNotFound, commandID)
+	}
+	return command, err
+}
+
+// List returns the latest commands of a station, or of all stations when
+// stationTopic is empty.
+func (s *CommandService) List(ctx context.Context, stationTopic string, limit int) ([]models.Command, error) {
+	return s.commandRepository.FindByStation(ctx, stationTopic, limit)
+}
+
+// Wait polls a command until it is completed or ctx expires.
+func (s *CommandService) Wait(ctx context.Context, commandID string) (*models.Command, error) {
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		command, err := s.Get(ctx, commandID)
+		if err != nil {
+			return nil, err
+		}
+		if command.IsCompleted() {
+			return command, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return command, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run sends due commands every poll interval while isLeader reports true,
+// until ctx is cancelled.
+func (s *CommandService) Run(ctx context.Context, isLeader func() bool) {
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if isLeader() {
+				s.processDue(ctx)
+			}
+		}
+	}
+}
+
+func (s *CommandService) processDue(ctx context.Context) {
+	now := time.Now()
+
+	commands, err := s.commandRepository.FindDue(ctx, now, commandBatchSize)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to load due commands")
+		return
+	}
+
+	for i := range commands {
+		s.attempt(ctx, &commands[i], now)
+	}
+}
+
+// attempt sends command once more, or marks it timed out when all attempts
+// went unacknowledged.
+func (s *CommandService) attempt(ctx context.Context, command *models.Command, now time.Time) {
+	if command.Attempts >= command.MaxAttempts {
+		s.complete(ctx, command, models.CommandStatusTimedOut, nil,
+			fmt.Sprintf("no ack after %d attempts", command.Attempts))
+		return
+	}
+
+	attempt := command.Attempts + 1
+	request := mq.CommandRequest{
+		ID:       command.CommandID,
+		Command:  command.Name,
+		Params:   command.Params,
+		Attempt:  attempt,
+		IssuedAt: command.CreatedAt.UTC(),
+	}
+
+	// Commands must not be delivered to a station long after the sender gave
+	// up on them, e.g. a reboot after the station came back online.
+	options := mq.DefaultMessageOptions()
+	options.Qos = 1
+	options.Retained = false
+	options.MessageExpiry = s.config.AckTimeout
+
+	nextAttemptAt := now.Add(s.config.AckTimeout)
+	if attempt < command.MaxAttempts {
+		nextAttemptAt = nextAttemptAt.Add(s.config.RetryBackoff << (attempt - 1))
+	}
+
+	updates := map[string]interface{}{
+		"attempts":        attempt,
+		"last_sent_at":    now,
+		"next_attempt_at": nextAttemptAt,
+	}
+
+	topic := s.topicManager.GetStationCommandTopic(command.StationTopic)
+	if err := s.client.PublishJsonWithOptions(topic, request, options); err != nil {
+		s.logger.Error().Err(err).
+			Str("command_id", command.CommandID).
+			Str("topic", topic).
+			Int("attempt", attempt).
+			Msg("Failed to send command")
+		updates["error"] = err.Error()
+	} else {
+		s.logger.Debug().
+			Str("command_id", command.CommandID).
+			Str("topic", topic).
+			Int("attempt", attempt).
+			Msg("Sent command")
+	}
+
+	if _, err := s.commandRepository.UpdatePending(ctx, command.ID, updates); err != nil {
+		s.logger.Error().Err(err).
+			Str("command_id", command.CommandID).
+			Msg("Failed to update command")
+	}
+}
+
+// HandleAck completes the command acknowledged by the station published on
+// stationTopic. Acks for completed commands, e.g. for a retry, are ignored.
+func (s *CommandService) HandleAck(ctx context.Context, stationTopic string, ack *mq.CommandAck) error {
+	command, err := s.Get(ctx, ack.ID)
+	if err != nil {
+		return err
+	}
+
+	if command.StationTopic != stationTopic {
+		return fmt.Errorf("command %s was sent to station %s, not %s", command.CommandID, command.StationTopic, stationTopic)
+	}
+
+	if command.IsCompleted() {
+		s.logger.Debug().
+			Str("command_id", command.CommandID).
+			Str("status", string(command.Status)).
+			Msg("Ignoring ack for completed command")
+		return nil
+	}
+
+	var status models.CommandStatus
+	switch ack.Status {
+	case mq.CommandAckStatusOK:
+		status = models.CommandStatusAcked
+	case mq.CommandAckStatusError:
+		status = models.CommandStatusFailed
+	default:
+		return fmt.Errorf("unknown ack status %q", ack.Status)
+	}
+
+	var result models.JSONMap
+	if len(ack.Result) > 0 {
+		if err := json.Unmarshal(ack.Result, &result); err != nil {
+			result = models.JSONMap{"value": json.RawMessage(ack.Result)}
+		}
+	}
+
+	s.complete(ctx, command, status, result, ack.Error)
+	return nil
+}
+
+func (s *CommandService) complete(ctx context.Context, command *models.Command, status models.CommandStatus, result models.JSONMap, reason string) {
+	updates := map[string]interface{}{
+		"status":          status,
+		"completed_at":    time.Now(),
+		"next_attempt_at": nil,
+		"error":           reason,
+	}
+	if result != nil {
+		updates["result"] = result
+	}
+
+	updated, err := s.commandRepository.UpdatePending(ctx, command.ID, updates)
+	if err != nil {
+		s.logger.Error().Err(err).
+			Str("command_id", command.CommandID).
+			Msg("Failed to complete command")
+		return
+	}
+	if !updated {
+		return
+	}
+
+	event := s.logger.Info()
+	if status != models.CommandStatusAcked {
+		event = s.logger.Warn().Str("error", reason)
+	}
+	event.
+		Str("command_id", command.CommandID).
+		Str("station", command.StationTopic).
+		Str("command", string(command.Name)).
+		Str("status", string(status)).
+		Int("attempts", command.Attempts).
+		Msg("Command completed")
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gps-no-sync/internal/models"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DedupStats are the counters of a MeasurementDeduplicator since startup.
+type DedupStats struct {
+	Duplicates uint64 `json:"duplicates"`
+	Evictions  uint64 `json:"evictions"`
+	Entries    int    `json:"entries"`
+}
+
+type dedupEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// MeasurementDeduplicator remembers the measurements stored within a time
+// window so QoS 1 redeliveries and device retries are not written twice. The
+// number of remembered measurements is capped, the oldest are forgotten first.
+type MeasurementDeduplicator struct {
+	window     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+
+	duplicates atomic.Uint64
+	evictions  atomic.Uint64
+}
+
+func NewMeasurementDeduplicator(window time.Duration, maxEntries int) *MeasurementDeduplicator {
+	return &MeasurementDeduplicator{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// DedupKey identifies a measurement by station and measurement id, or by a
+// hash of its content when the device did not assign an id. The hash uses the
+// timestamp sent by the device, as the receive time filled in for
+// measurements without one differs between redeliveries. Devices sending
+// neither id nor timestamp therefore cannot repeat a value within the window.
+func DedupKey(measurement models.Measurement) string {
+	if measurement.ID != "" {
+		return measurement.StationID + "/" + measurement.ID
+	}
+
+	content, err := json.Marshal(struct {
+		StationID string                 `json:"station_id"`
+		Type      models.MeasurementType `json:"type"`
+		Value     interface{}            `json:"value"`
+		Unit      string                 `json:"unit"`
+		Metadata  map[string]interface{} `json:"metadata"`
+		Timestamp time.Time              `json:"timestamp"`
+	}{
+		StationID: measurement.StationID,
+		Type:      measurement.Type,
+		Value:     measurement.Value,
+		Unit:      measurement.Unit,
+		Metadata:  measurement.Metadata,
+		Timestamp: measurement.RawTimestamp,
+	})
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(content)
+	return measurement.StationID + "#" + hex.EncodeToString(sum[:])
+}
+
+// Filter drops the measurements that were already stored within the window or
+// occur twice in measurements, and returns the rest with their keys. The keys
+// must be passed to Remember once the measurements are stored.
+func (d *MeasurementDeduplicator) Filter(measurements []models.Measurement) ([]models.Measurement, []string) {
+	if d == nil {
+		return measurements, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(time.Now())
+
+	fresh := make([]models.Measurement, 0, len(measurements))
+	keys := make([]string, 0, len(measurements))
+	inBatch := make(map[string]bool, len(measurements))
+
+	for _, measurement := range measurements {
+		key := DedupKey(measurement)
+		if key != "" {
+			if _, seen := d.entries[key]; seen || inBatch[key] {
+				d.duplicates.Add(1)
+				continue
+			}
+			inBatch[key] = true
+		}
+
+		fresh = append(fresh, measurement)
+		keys = append(keys, key)
+	}
+
+	return fresh, keys
+}
+
+// Remember marks keys as stored.
+func (d *MeasurementDeduplicator) Remember(keys []string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expiresAt := time.Now().Add(d.window)
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		if element, exists := d.entries[key]; exists {
+			d.order.Remove(element)
+		}
+		d.entries[key] = d.order.PushBack(&dedupEntry{key: key, expiresAt: expiresAt})
+
+		for d.order.Len() > d.maxEntries {
+			d.remove(d.order.Front())
+			d.evictions.Add(1)
+		}
+	}
+}
+
+func (d *MeasurementDeduplicator) Stats() DedupStats {
+	if d == nil {
+		return DedupStats{}
+	}
+
+	d.mu.Lock()
+	entries := d.order.Len()
+	d.mu.Unlock()
+
+	return DedupStats{
+		Duplicates: d.duplicates.Load(),
+		Evictions:  d.evictions.Load(),
+		Entries:    entries,
+	}
+}
+
+// expire forgets entries older than the window. Entries are kept in insertion
+// order, which is also expiry order because the window is fixed.
+func (d *MeasurementDeduplicator) expire(now time.Time) {
+	for element := d.order.Front(); element != nil; element = d.order.Front() {
+		if element.Value.(*dedupEntry).expiresAt.After(now) {
+			return
+		}
+		d.remove(element)
+	}
+}
+
+func (d *MeasurementDeduplicator) remove(element *list.Element) {
+	delete(d.entries, element.Value.(*dedupEntry).key)
+	d.order.Remove(element)
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	"gps-no-sync/internal/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDedupKey(t *testing.T) {
+	deviceTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	base := models.Measurement{
+		StationID:    "a1",
+		Type:         models.MeasurementTypeUWBDistance,
+		Value:        1.5,
+		Unit:         "m",
+		Timestamp:    deviceTime,
+		RawTimestamp: deviceTime,
+		ReceivedAt:   deviceTime,
+	}
+
+	tests := []struct {
+		name   string
+		change func(m *models.Measurement)
+		same   bool
+	}{
+		{
+			name:   "identical content",
+			change: func(m *models.Measurement) {},
+			same:   true,
+		},
+		{
+			name: "corrected timestamp and receive time are ignored",
+			change: func(m *models.Measurement) {
+				m.Timestamp = m.Timestamp.Add(time.Second)
+				m.ReceivedAt = m.ReceivedAt.Add(time.Minute)
+			},
+			same: true,
+		},
+		{
+			name:   "different device timestamp",
+			change: func(m *models.Measurement) { m.RawTimestamp = m.RawTimestamp.Add(time.Second) },
+		},
+		{
+			name:   "different value",
+			change: func(m *models.Measurement) { m.Value = 2.5 },
+		},
+		{
+			name:   "different station",
+			change: func(m *models.Measurement) { m.StationID = "b2" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := base
+			tt.change(&changed)
+
+			if got := DedupKey(changed) == DedupKey(base); got != tt.same {
+				t.Errorf("keys equal = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestDedupKeyPrefersMeasurementID(t *testing.T) {
+	first := models.Measurement{ID: "m1", StationID: "a1", Value: 1.0}
+	second := models.Measurement{ID: "m1", StationID: "a1", Value: 2.0}
+
+	if DedupKey(first) != "a1/m1" || DedupKey(second) != "a1/m1" {
+		t.Errorf("keys = %s, %s, want a1/m1", DedupKey(first), DedupKey(second))
+	}
+}
+
+func TestMeasurementDeduplicatorFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		remembered []string
+		batch      []string
+		want       []string
+		wantDups   uint64
+		wantEvicts uint64
+	}{
+		{
+			name:       "fresh measurements pass",
+			maxEntries: 10,
+			batch:      []string{"m1", "m2"},
+			want:       []string{"m1", "m2"},
+		},
+		{
+			name:       "stored measurements are dropped",
+			maxEntries: 10,
+			remembered: []string{"m1"},
+			batch:      []string{"m1", "m2"},
+			want:       []string{"m2"},
+			wantDups:   1,
+		},
+		{
+			name:       "repeats within a batch are dropped",
+			maxEntries: 10,
+			batch:      []string{"m1", "m1", "m2"},
+			want:       []string{"m1", "m2"},
+			wantDups:   1,
+		},
+		{
+			name:       "cap forgets oldest first",
+			maxEntries: 2,
+			remembered: []string{"m1", "m2", "m3"},
+			batch:      []string{"m1", "m2", "m3"},
+			want:       []string{"m1"},
+			wantDups:   2,
+			wantEvicts: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewMeasurementDeduplicator(time.Minute, tt.maxEntries)
+
+			if len(tt.remembered) > 0 {
+				_, keys := d.Filter(measurementsWithIDs(tt.remembered))
+				d.Remember(keys)
+			}
+
+			fresh, keys := d.Filter(measurementsWithIDs(tt.batch))
+			if got := measurementIDs(fresh); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fresh = %v, want %v", got, tt.want)
+			}
+			if len(keys) != len(fresh) {
+				t.Errorf("got %d keys for %d measurements", len(keys), len(fresh))
+			}
+
+			stats := d.Stats()
+			if stats.Duplicates != tt.wantDups || stats.Evictions != tt.wantEvicts {
+				t.Errorf("stats = %+v, want %d duplicates and %d evictions", stats, tt.wantDups, tt.wantEvicts)
+			}
+			if stats.Entries > tt.maxEntries {
+				t.Errorf("%d entries exceed the cap of %d", stats.Entries, tt.maxEntries)
+			}
+		})
+	}
+}
+
+func TestMeasurementDeduplicatorWindow(t *testing.T) {
+	d := NewMeasurementDeduplicator(20*time.Millisecond, 10)
+
+	_, keys := d.Filter(measurementsWithIDs([]string{"m1"}))
+	d.Remember(keys)
+
+	if fresh, _ := d.Filter(measurementsWithIDs([]string{"m1"})); len(fresh) != 0 {
+		t.Errorf("measurement within the window was not dropped")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if fresh, _ := d.Filter(measurementsWithIDs([]string{"m1"})); len(fresh) != 1 {
+		t.Errorf("measurement after the window was dropped")
+	}
+	if entries := d.Stats().Entries; entries != 0 {
+		t.Errorf("%d entries remain after the window", entries)
+	}
+}
+
+func TestMeasurementDeduplicatorNil(t *testing.T) {
+	var d *MeasurementDeduplicator
+
+	measurements := measurementsWithIDs([]string{"m1", "m1"})
+	fresh, keys := d.Filter(measurements)
+	if len(fresh) != 2 || keys != nil {
+		t.Errorf("nil deduplicator filtered measurements: %v, %v", fresh, keys)
+	}
+	d.Remember([]string{"a1/m1"})
+}
+
+func measurementsWithIDs(ids []string) []models.Measurement {
+	measurements := make([]models.Measurement, len(ids))
+	for i, id := range ids {
+		measurements[i] = models.Measurement{ID: id, StationID: "a1"}
+	}
+	return measurements
+}
+
+func measurementIDs(measurements []models.Measurement) []string {
+	ids := make([]string, len(measurements))
+	for i, measurement := range measurements {
+		ids[i] = measurement.ID
+	}
+	return ids
+}
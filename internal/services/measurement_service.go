@@ -12,59 +12,186 @@ import (
 
 type MeasurementService struct {
 	influxDB     *influxdb.InfluxDB
+	client       *mq.Client
 	topicManager *mq.TopicManager
 	logger       zerolog.Logger
+	deduplicator *MeasurementDeduplicator
+	clocks       *ClockEstimator
+	liveness     *LivenessService
 }
 
+// NewMeasurementService creates the service, deduplicator may be nil to store
+// every measurement received, clocks may be nil to keep device timestamps as
+// they are and liveness may be nil to not track the stations sending them.
 func NewMeasurementService(
 	influxDB *influxdb.InfluxDB,
+	client *mq.Client,
 	topicManager *mq.TopicManager,
 	logger zerolog.Logger,
+	deduplicator *MeasurementDeduplicator,
+	clocks *ClockEstimator,
+	liveness *LivenessService,
 ) *MeasurementService {
 	return &MeasurementService{
 		influxDB:     influxDB,
+		client:       client,
 		topicManager: topicManager,
 		logger:       logger,
+		deduplicator: deduplicator,
+		clocks:       clocks,
+		liveness:     liveness,
 	}
 }
 
 func (s *MeasurementService) ProcessMessage(ctx context.Context, measurementMessage *mq.MeasurementMessage) error {
-	if measurementMessage.Source == "SYNC" {
+	return s.ProcessBatch(ctx, &mq.MeasurementBatchMessage{
+		Data:       []models.Measurement{measurementMessage.Data},
+		Provenance: measurementMessage.Provenance,
+		Topic:      measurementMessage.Topic,
+	})
+}
+
+// ProcessBatch stores all valid measurements of a message with a single write.
+func (s *MeasurementService) ProcessBatch(ctx context.Context, batchMessage *mq.MeasurementBatchMessage) error {
+	if s.client.IsEcho(batchMessage.Provenance) {
 		return nil
 	}
 
-	measurement := measurementMessage.Data
-	measurement.ReceivedAt = time.Now()
+	receivedAt := batchMessage.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	measurements := make([]models.Measurement, 0, len(batchMessage.Data))
+
+	for _, measurement := range batchMessage.Data {
+		measurement.ReceivedAt = receivedAt
+
+		if measurement.StationID == "" {
+			measurement.StationID = s.topicManager.ExtractMeasurementStationId(batchMessage.Topic)
+		}
+
+		if err := measurement.Validate(); err != nil {
+			s.logger.Error().Err(err).
+				Str("topic", batchMessage.Topic).
+				Str("station_id", measurement.StationID).
+				Msg("Invalid measurement received")
+			continue
+		}
 
-	if measurement.StationID == "" {
-		measurement.StationID = s.topicManager.ExtractStationId(measurementMessage.Topic)
+		measurements = append(measurements, measurement)
 	}
 
-	if err := measurement.Validate(); err != nil {
-		s.logger.Error().Err(err).
-			Str("topic", measurementMessage.Topic).
-			Str("station_id", measurement.StationID).
-			Msg("Invalid measurement received")
-		return fmt.Errorf("invalid measurement: %w", err)
+	if len(measurements) == 0 {
+		return fmt.Errorf("invalid measurement: no valid measurements in message")
+	}
+
+	stationTopic := s.topicManager.ExtractMeasurementStationId(batchMessage.Topic)
+	if err := s.liveness.Seen(ctx, stationTopic, receivedAt); err != nil {
+		s.logger.Warn().Err(err).
+			Str("topic", batchMessage.Topic).
+			Msg("Failed to track station liveness")
 	}
 
-	if err := s.StoreMeasurement(ctx, &measurement); err != nil {
+	fresh, keys := s.deduplicator.Filter(measurements)
+	if dropped := len(measurements) - len(fresh); dropped > 0 {
+		stats := s.deduplicator.Stats()
+		s.logger.Debug().
+			Str("topic", batchMessage.Topic).
+			Int("dropped", dropped).
+			Uint64("duplicates_total", stats.Duplicates).
+			Msg("Dropped duplicate measurements")
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+	measurements = fresh
+
+	// Correct after de-duplication, which compares the device timestamps.
+	clockPoints := s.correctTimestamps(measurements, receivedAt)
+
+	if err := s.StoreMeasurements(ctx, measurements); err != nil {
 		s.logger.Error().Err(err).
-			Str("station_id", measurement.StationID).
-			Str("type", string(measurement.Type)).
-			Msg("Failed to store measurement")
-		return fmt.Errorf("failed to store measurement: %w", err)
+			Str("topic", batchMessage.Topic).
+			Int("measurements", len(measurements)).
+			Msg("Failed to store measurements")
+		return fmt.Errorf("failed to store measurements: %w", err)
+	}
+	s.deduplicator.Remember(keys)
+
+	if len(clockPoints) > 0 {
+		if err := s.influxDB.WriteMeasurementsSync("measurement", clockPoints); err != nil {
+			s.logger.Warn().Err(err).
+				Str("topic", batchMessage.Topic).
+				Msg("Failed to store clock estimates")
+		}
 	}
 
 	s.logger.Debug().
-		Str("station_id", measurement.StationID).
-		Str("type", string(measurement.Type)).
-		Time("timestamp", measurement.Timestamp).
-		Msg("Measurement processed successfully")
+		Str("topic", batchMessage.Topic).
+		Int("measurements", len(measurements)).
+		Msg("Measurements processed successfully")
 
 	return nil
 }
 
+// correctTimestamps updates the clock estimate of every station in
+// measurements and converts their device timestamps to server time. It returns
+// the estimates that are due to be stored.
+func (s *MeasurementService) correctTimestamps(measurements []models.Measurement, receivedAt time.Time) []influxdb.MeasurementPoint {
+	if s.clocks == nil {
+		return nil
+	}
+
+	// Batches may contain measurements buffered on the device, only the newest
+	// one was taken right before sending.
+	newest := make(map[string]time.Time)
+	for _, measurement := range measurements {
+		if measurement.RawTimestamp.After(newest[measurement.StationID]) {
+			newest[measurement.StationID] = measurement.RawTimestamp
+		}
+	}
+
+	var points []influxdb.MeasurementPoint
+	for stationID, deviceTime := range newest {
+		estimate, report := s.clocks.Observe(stationID, deviceTime, receivedAt)
+		if !report {
+			continue
+		}
+
+		if s.clocks.IsSkewed(estimate) {
+			s.logger.Warn().
+				Str("station_id", stationID).
+				Dur("offset", estimate.Offset).
+				Float64("drift_ppm", estimate.DriftPPM).
+				Msg("Station clock is skewed, check NTP on the station")
+		}
+
+		points = append(points, influxdb.MeasurementPoint{
+			Measurement: "clock_skew",
+			Tags:        map[string]string{"station_id": stationID},
+			Fields: map[string]interface{}{
+				"offset_ms": float64(estimate.Offset) / float64(time.Millisecond),
+				"drift_ppm": estimate.DriftPPM,
+				"samples":   estimate.Samples,
+			},
+			Timestamp: receivedAt,
+		})
+	}
+
+	for i := range measurements {
+		if !measurements[i].RawTimestamp.IsZero() {
+			measurements[i].Timestamp = s.clocks.Correct(measurements[i].StationID, measurements[i].RawTimestamp)
+		}
+	}
+
+	return points
+}
+
+// ClockEstimates returns the clock estimate of every station seen so far.
+func (s *MeasurementService) ClockEstimates() []ClockEstimate {
+	return s.clocks.Estimates()
+}
+
 func (s *MeasurementService) StoreMeasurement(ctx context.Context, measurement *models.Measurement) error {
 	tags := measurement.GetTags()
 	fields := measurement.GetFields()
@@ -91,3 +218,27 @@ func (s *MeasurementService) StoreMeasurement(ctx context.Context, measurement *
 
 	return nil
 }
+
+func (s *MeasurementService) StoreMeasurements(ctx context.Context, measurements []models.Measurement) error {
+	points := make([]influxdb.MeasurementPoint, len(measurements))
+	for i, measurement := range measurements {
+		points[i] = influxdb.MeasurementPoint{
+			Measurement: string(measurement.Type),
+			Tags:        measurement.GetTags(),
+			Fields:      measurement.GetFields(),
+			Timestamp:   measurement.Timestamp,
+		}
+	}
+
+	if err := s.influxDB.WriteMeasurementsSync("measurement", points); err != nil {
+		return fmt.Errorf("failed to write measurements to InfluxConfig: %w", err)
+	}
+
+	return nil
+}
+
+// DedupStats returns the de-duplication counters, all zero when
+// de-duplication is disabled.
+func (s *MeasurementService) DedupStats() DedupStats {
+	return s.deduplicator.Stats()
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"gps-no-sync/internal/models"
+	"time"
+)
+
+const (
+	ConflictPolicyDBWins         = "db-wins"
+	ConflictPolicyDeviceWins     = "device-wins"
+	ConflictPolicyLastWriterWins = "last-writer-wins"
+)
+
+var ErrStaleRevision = errors.New("stale station revision")
+
+// StationConflict is reported to the sender of a rejected station update. It
+// carries the current state, so the device can rebase its change on it.
+type StationConflict struct {
+	Topic           string             `json:"topic"`
+	MacAddress      string             `json:"mac_address"`
+	Policy          string             `json:"policy"`
+	Revision        uint64             `json:"revision"`
+	CurrentRevision uint64             `json:"current_revision"`
+	Current         *models.StationDto `json:"current"`
+	Reason          string             `json:"reason"`
+	DetectedAt      time.Time          `json:"detected_at"`
+}
+
+type ConflictError struct {
+	Conflict StationConflict
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrStaleRevision, e.Conflict.Reason)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrStaleRevision
+}
+
+// checkRevision decides whether the update dto may be applied to station
+// according to policy. Updates based on the current or a newer revision are
+// always accepted, and so are updates without a revision, which come from
+// senders that do not track revisions and are applied as the latest write.
+func checkRevision(policy string, station *models.Station, dto *models.StationDto) *ConflictError {
+	if dto.Revision == nil || *dto.Revision >= station.Revision {
+		return nil
+	}
+
+	reason := fmt.Sprintf("update is based on revision %d, current revision is %d", *dto.Revision, station.Revision)
+
+	switch policy {
+	case ConflictPolicyDeviceWins:
+		return nil
+	case ConflictPolicyLastWriterWins:
+		if dto.UpdatedAt != nil && (station.UpdatedAt == nil || dto.UpdatedAt.After(*station.UpdatedAt)) {
+			return nil
+		}
+		reason += ", and it is not newer than the current state"
+	}
+
+	return &ConflictError{Conflict: StationConflict{
+		Topic:           station.Topic,
+		MacAddress:      station.MacAddress,
+		Policy:          policy,
+		Revision:        *dto.Revision,
+		CurrentRevision: station.Revision,
+		Current:         station.ToDto(),
+		Reason:          reason,
+		DetectedAt:      time.Now().UTC(),
+	}}
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"errors"
+	"gps-no-sync/internal/models"
+	"testing"
+	"time"
+)
+
+func TestCheckRevision(t *testing.T) {
+	stored := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	older := stored.Add(-time.Minute)
+	newer := stored.Add(time.Minute)
+
+	tests := []struct {
+		name            string
+		policy          string
+		revision        *uint64
+		updatedAt       *time.Time
+		storedUpdatedAt *time.Time
+		wantConflict    bool
+	}{
+		{name: "db wins accepts current revision", policy: ConflictPolicyDBWins, revision: revision(5), storedUpdatedAt: &stored},
+		{name: "db wins accepts newer revision", policy: ConflictPolicyDBWins, revision: revision(6), storedUpdatedAt: &stored},
+		{name: "db wins rejects stale revision", policy: ConflictPolicyDBWins, revision: revision(4), updatedAt: &newer, storedUpdatedAt: &stored, wantConflict: true},
+		{name: "device wins accepts stale revision", policy: ConflictPolicyDeviceWins, revision: revision(4), storedUpdatedAt: &stored},
+		{name: "last writer wins accepts newer state", policy: ConflictPolicyLastWriterWins, revision: revision(4), updatedAt: &newer, storedUpdatedAt: &stored},
+		{name: "last writer wins rejects older state", policy: ConflictPolicyLastWriterWins, revision: revision(4), updatedAt: &older, storedUpdatedAt: &stored, wantConflict: true},
+		{name: "last writer wins rejects same time", policy: ConflictPolicyLastWriterWins, revision: revision(4), updatedAt: &stored, storedUpdatedAt: &stored, wantConflict: true},
+		{name: "last writer wins rejects missing time", policy: ConflictPolicyLastWriterWins, revision: revision(4), storedUpdatedAt: &stored, wantConflict: true},
+		{name: "last writer wins accepts when stored time is unknown", policy: ConflictPolicyLastWriterWins, revision: revision(4), updatedAt: &older},
+		{name: "db wins accepts missing revision", policy: ConflictPolicyDBWins, storedUpdatedAt: &stored},
+		{name: "device wins accepts missing revision", policy: ConflictPolicyDeviceWins, storedUpdatedAt: &stored},
+		{name: "last writer wins accepts missing revision", policy: ConflictPolicyLastWriterWins, updatedAt: &older, storedUpdatedAt: &stored},
+		{name: "unknown policy rejects stale revision", policy: "unknown", revision: revision(4), updatedAt: &newer, storedUpdatedAt: &stored, wantConflict: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			station := &models.Station{
+				MacAddress: "aa:bb:cc:dd:ee:ff",
+				Topic:      "a1",
+				Revision:   5,
+				UpdatedAt:  tt.storedUpdatedAt,
+			}
+			dto := &models.StationDto{
+				MacAddress: station.MacAddress,
+				Revision:   tt.revision,
+				UpdatedAt:  tt.updatedAt,
+			}
+
+			conflictErr := checkRevision(tt.policy, station, dto)
+			if (conflictErr != nil) != tt.wantConflict {
+				t.Fatalf("conflict = %v, want conflict %v", conflictErr, tt.wantConflict)
+			}
+			if conflictErr == nil {
+				return
+			}
+
+			if !errors.Is(conflictErr, ErrStaleRevision) {
+				t.Errorf("error %v does not wrap ErrStaleRevision", conflictErr)
+			}
+			conflict := conflictErr.Conflict
+			if conflict.Policy != tt.policy || conflict.Revision != *tt.revision || conflict.CurrentRevision != 5 {
+				t.Errorf("conflict = %+v, want policy %s and revisions %d/5", conflict, tt.policy, *tt.revision)
+			}
+			if conflict.Topic != "a1" || conflict.Current == nil || conflict.Current.BaseRevision() != 5 {
+				t.Errorf("conflict does not carry the current state: %+v", conflict)
+			}
+		})
+	}
+}
+
+func revision(n uint64) *uint64 {
+	return &n
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"gps-no-sync/internal/database/influxdb"
+	"gps-no-sync/internal/database/postgres/repositories"
+	"gps-no-sync/internal/mq"
+	"sync"
+	"time"
+)
+
+// LivenessService tracks when stations were last seen, through heartbeats and
+// measurements, and marks stations offline once they were silent for longer
+// than the timeout.
+//
+// To keep the database load independent of the measurement rate, last_seen_at
+// is written at most once per update interval and station. It may therefore
+// lag behind by up to one interval, which is why the timeout has to be longer.
+type LivenessService struct {
+	stationRepository *repositories.StationRepository
+	influxDB          *influxdb.InfluxDB
+	client            *mq.Client
+	topicManager      *mq.TopicManager
+	updateInterval    time.Duration
+	timeout           time.Duration
+	logger            zerolog.Logger
+
+	mu      sync.Mutex
+	written map[string]time.Time
+}
+
+func NewLivenessService(
+	stationRepository *repositories.StationRepository,
+	influxDB *influxdb.InfluxDB,
+	client *mq.Client,
+	topicManager *mq.TopicManager,
+	updateInterval time.Duration,
+	timeout time.Duration,
+	logger zerolog.Logger,
+) *LivenessService {
+	return &LivenessService{
+		stationRepository: stationRepository,
+		influxDB:          influxDB,
+		client:            client,
+		topicManager:      topicManager,
+		updateInterval:    updateInterval,
+		timeout:           timeout,
+		logger:            logger,
+		written:           make(map[string]time.Time),
+	}
+}
+
+// Seen records that the station published on topic id stationTopic was active
+// at seenAt, and publishes its status when it was offline before.
+func (s *LivenessService) Seen(ctx context.Context, stationTopic string, seenAt time.Time) error {
+	if s == nil || stationTopic == "" {
+		return nil
+	}
+
+	if !s.due(stationTopic, seenAt) {
+		return nil
+	}
+
+	cameOnline, err := s.stationRepository.MarkSeen(ctx, stationTopic, seenAt)
+	if err != nil {
+		s.forget(stationTopic)
+		return fmt.Errorf("failed to update last seen time: %w", err)
+	}
+
+	if cameOnline {
+		s.logger.Info().
+			Str("station", stationTopic).
+			Msg("Station is online")
+		s.transition(stationTopic, mq.StationStatusOnline, &seenAt, time.Now())
+	}
+
+	return nil
+}
+
+// Run marks silent stations offline every update interval while isLeader
+// reports true, until ctx is cancelled.
+func (s *LivenessService) Run(ctx context.Context, isLeader func() bool) {
+	ticker := time.NewTicker(s.updateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.prune(now.Add(-s.updateInterval))
+			if isLeader() {
+				s.sweep(ctx)
+			}
+		}
+	}
+}
+
+func (s *LivenessService) sweep(ctx context.Context) {
+	now := time.Now()
+
+	stations, err := s.stationRepository.MarkOffline(ctx, now.Add(-s.timeout))
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to mark silent stations offline")
+		return
+	}
+
+	for _, station := range stations {
+		// The next message of the station has to bring it back online right away.
+		s.forget(station.Topic)
+
+		s.logger.Warn().
+			Str("station", station.Topic).
+			Time("last_seen_at", timeOrZero(station.LastSeenAt)).
+			Msg("Station is offline")
+		s.transition(station.Topic, mq.StationStatusOffline, station.LastSeenAt, now)
+	}
+}
+
+// transition publishes the retained status of a station and records the
+// change in InfluxDB.
+func (s *LivenessService) transition(stationTopic, status string, lastSeenAt *time.Time, changedAt time.Time) {
+	options := mq.DefaultMessageOptions()
+	options.Qos = 1
+	options.Retained = true
+
+	topic := s.topicManager.GetStationStatusTopic(stationTopic)
+	err := s.client.PublishJsonWithOptions(topic, mq.StationStatus{
+		Status:     status,
+		LastSeenAt: lastSeenAt,
+		ChangedAt:  changedAt.UTC(),
+	}, options)
+	if err != nil {
+		s.logger.Error().Err(err).
+			Str("topic", topic).
+			Str("status", status).
+			Msg("Failed to publish station status")
+	}
+
+	point := influxdb.MeasurementPoint{
+		Measurement: "station_status",
+		Tags:        map[string]string{"station_id": stationTopic},
+		Fields: map[string]interface{}{
+			"status": status,
+			"online": status == mq.StationStatusOnline,
+		},
+		Timestamp: changedAt,
+	}
+	if err := s.influxDB.WriteMeasurementsSync("measurement", []influxdb.MeasurementPoint{point}); err != nil {
+		s.logger.Warn().Err(err).
+			Str("station", stationTopic).
+			Str("status", status).
+			Msg("Failed to store station status change")
+	}
+}
+
+// due reports whether last_seen_at of the station has to be written for a
+// message at seenAt, and if so remembers it as written.
+func (s *LivenessService) due(stationTopic string, seenAt time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if writtenAt, exists := s.written[stationTopic]; exists && seenAt.Sub(writtenAt) < s.updateInterval {
+		return false
+	}
+	s.written[stationTopic] = seenAt
+	return true
+}
+
+func (s *LivenessService) forget(stationTopic string) {
+	s.mu.Lock()
+	delete(s.written, stationTopic)
+	s.mu.Unlock()
+}
+
+// prune drops the stations written before cutoff. They are due on their next
+// message anyway, and topics of stations that are gone or never existed would
+// otherwise stay in the map forever.
+func (s *LivenessService) prune(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for stationTopic, writtenAt := range s.written {
+		if writtenAt.Before(cutoff) {
+			delete(s.written, stationTopic)
+		}
+	}
+}
+
+func timeOrZero(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"gps-no-sync/internal/models"
+	"time"
+)
+
+// patchStation applies the JSON merge patch to the synced state of station.
+// The merged state is checked with validate, may not change the MAC address
+// and may only reference clusters for which clusterExists returns true, a
+// cluster id of null or 0 removes the station from its cluster. Stale patches
+// are rejected according to conflictPolicy with a *ConflictError.
+func patchStation(station *models.Station, patch []byte, validate func(data []byte) error, clusterExists func(clusterID uint) bool, conflictPolicy string) error {
+	if !station.IsApproved() {
+		return fmt.Errorf("%w: %s", ErrStationNotApproved, station.Topic)
+	}
+
+	current, err := json.Marshal(station.ToDto())
+	if err != nil {
+		return err
+	}
+
+	merged, err := jsonpatch.MergePatch(current, patch)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	if err := validate(merged); err != nil {
+		return err
+	}
+
+	var stationDto models.StationDto
+	if err := json.Unmarshal(merged, &stationDto); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+
+	if stationDto.MacAddress != station.MacAddress {
+		return fmt.Errorf("%w: mac_address cannot be changed", ErrInvalidPatch)
+	}
+
+	if stationDto.ClusterID != nil && *stationDto.ClusterID > 0 {
+		if !clusterExists(*stationDto.ClusterID) {
+			return fmt.Errorf("%w: unknown cluster %d", ErrInvalidPatch, *stationDto.ClusterID)
+		}
+	} else {
+		stationDto.ClusterID = nil
+	}
+
+	if conflict := checkRevision(conflictPolicy, station, &stationDto); conflict != nil {
+		return conflict
+	}
+
+	now := time.Now()
+	station.UpdateFromDto(&stationDto)
+	station.Revision = max(station.Revision, stationDto.BaseRevision()) + 1
+	station.UpdatedAt = &now
+	return nil
+}
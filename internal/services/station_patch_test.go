@@ -0,0 +1,118 @@
+package services
+
+import (
+	"errors"
+	"gps-no-sync/internal/models"
+	"testing"
+)
+
+func TestPatchStation(t *testing.T) {
+	errSchema := errors.New("schema validation failed")
+	clusterID := uint(3)
+
+	tests := []struct {
+		name          string
+		status        models.ProvisioningStatus
+		patch         string
+		validateErr   error
+		wantErr       error
+		wantName      string
+		wantClusterID *uint
+		wantConfig    models.StationConfig
+	}{
+		{
+			name:          "name is patched",
+			patch:         `{"name":"b1"}`,
+			wantName:      "b1",
+			wantClusterID: &clusterID,
+			wantConfig:    models.StationConfig{UWB: &models.UWBConfig{Mode: models.DW3000ModeAnchor}},
+		},
+		{
+			name:       "null removes the cluster",
+			patch:      `{"cluster_id":null}`,
+			wantName:   "a1",
+			wantConfig: models.StationConfig{UWB: &models.UWBConfig{Mode: models.DW3000ModeAnchor}},
+		},
+		{
+			name:       "cluster 0 removes the cluster",
+			patch:      `{"cluster_id":0}`,
+			wantName:   "a1",
+			wantConfig: models.StationConfig{UWB: &models.UWBConfig{Mode: models.DW3000ModeAnchor}},
+		},
+		{
+			name:          "null removes nested config",
+			patch:         `{"config":{"uwb":null}}`,
+			wantName:      "a1",
+			wantClusterID: &clusterID,
+		},
+		{
+			name:          "known cluster is assigned",
+			patch:         `{"cluster_id":4}`,
+			wantName:      "a1",
+			wantClusterID: uintPointer(4),
+			wantConfig:    models.StationConfig{UWB: &models.UWBConfig{Mode: models.DW3000ModeAnchor}},
+		},
+		{name: "unknown cluster", patch: `{"cluster_id":9}`, wantErr: ErrInvalidPatch},
+		{name: "mac address cannot change", patch: `{"mac_address":"aa:bb:cc:dd:ee:02"}`, wantErr: ErrInvalidPatch},
+		{name: "mac address cannot be removed", patch: `{"mac_address":null}`, wantErr: ErrInvalidPatch},
+		{name: "invalid patch", patch: `{"name":`, wantErr: ErrInvalidPatch},
+		{name: "patched state fails validation", patch: `{"name":"b1"}`, validateErr: errSchema, wantErr: errSchema},
+		{name: "stale revision", patch: `{"revision":4,"name":"b1"}`, wantErr: ErrStaleRevision},
+		{name: "unapproved station", status: models.ProvisioningPending, patch: `{"name":"b1"}`, wantErr: ErrStationNotApproved},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == "" {
+				status = models.ProvisioningApproved
+			}
+			station := &models.Station{
+				MacAddress:         "aa:bb:cc:dd:ee:01",
+				Topic:              "a1",
+				Name:               "a1",
+				ClusterID:          &clusterID,
+				Config:             models.StationConfig{UWB: &models.UWBConfig{Mode: models.DW3000ModeAnchor}},
+				Revision:           5,
+				ProvisioningStatus: status,
+			}
+			validate := func(data []byte) error {
+				return tt.validateErr
+			}
+			clusterExists := func(id uint) bool {
+				return id == 3 || id == 4
+			}
+
+			err := patchStation(station, []byte(tt.patch), validate, clusterExists, ConflictPolicyDBWins)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("patchStation error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if station.Revision != 5 || station.Name != "a1" {
+					t.Errorf("rejected patch changed the station: %+v", station)
+				}
+				return
+			}
+
+			if station.Name != tt.wantName {
+				t.Errorf("name = %s, want %s", station.Name, tt.wantName)
+			}
+			if (station.ClusterID == nil) != (tt.wantClusterID == nil) || (station.ClusterID != nil && *station.ClusterID != *tt.wantClusterID) {
+				t.Errorf("cluster id = %v, want %v", station.ClusterID, tt.wantClusterID)
+			}
+			if (station.Config.UWB == nil) != (tt.wantConfig.UWB == nil) {
+				t.Errorf("config = %+v, want %+v", station.Config, tt.wantConfig)
+			}
+			if station.MacAddress != "aa:bb:cc:dd:ee:01" {
+				t.Errorf("mac address = %s, want it unchanged", station.MacAddress)
+			}
+			if station.Revision != 6 || station.UpdatedAt == nil {
+				t.Errorf("revision = %d, updated at %v, want revision 6 and an update time", station.Revision, station.UpdatedAt)
+			}
+		})
+	}
+}
+
+func uintPointer(n uint) *uint {
+	return &n
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gps-no-sync/internal/models"
+	"strings"
+)
+
+const (
+	ProvisioningPolicyOpen      = "open"
+	ProvisioningPolicyAllowlist = "allowlist"
+	ProvisioningPolicyManual    = "manual"
+)
+
+var ErrStationNotApproved = errors.New("station is not approved")
+
+// ProvisioningPolicy decides whether a station announcing itself for the first
+// time is approved right away or has to be approved by an operator.
+type ProvisioningPolicy struct {
+	mode     string
+	prefixes []string
+}
+
+// NewProvisioningPolicy creates a policy for mode. allowlist holds MAC
+// addresses or prefixes such as OUIs, with or without separators, and is only
+// used by the allowlist mode.
+func NewProvisioningPolicy(mode string, allowlist []string) *ProvisioningPolicy {
+	prefixes := make([]string, 0, len(allowlist))
+	for _, entry := range allowlist {
+		if prefix := compactMacAddress(entry); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return &ProvisioningPolicy{mode: mode, prefixes: prefixes}
+}
+
+// StatusFor returns the provisioning status of a new station. A nil policy
+// approves every station.
+func (p *ProvisioningPolicy) StatusFor(macAddress string) models.ProvisioningStatus {
+	if p == nil {
+		return models.ProvisioningApproved
+	}
+
+	switch p.mode {
+	case ProvisioningPolicyOpen:
+		return models.ProvisioningApproved
+	case ProvisioningPolicyAllowlist:
+		mac := compactMacAddress(macAddress)
+		for _, prefix := range p.prefixes {
+			if strings.HasPrefix(mac, prefix) {
+				return models.ProvisioningApproved
+			}
+		}
+		return models.ProvisioningPending
+	default:
+		return models.ProvisioningPending
+	}
+}
+
+// compactMacAddress lowercases a MAC address or prefix and strips separators.
+func compactMacAddress(macAddress string) string {
+	return strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.ToLower(strings.TrimSpace(macAddress)))
+}
+
+// normalizeMacAddress converts a MAC address to the colon separated lowercase
+// form stations are stored with.
+func normalizeMacAddress(macAddress string) string {
+	mac := compactMacAddress(macAddress)
+	if len(mac) != 12 {
+		return strings.ToLower(macAddress)
+	}
+
+	return fmt.Sprintf("%s:%s:%s:%s:%s:%s", mac[0:2], mac[2:4], mac[4:6], mac[6:8], mac[8:10], mac[10:12])
+}
+
+// Approve admits a pending or rejected station to the fleet. The station and
+// its cluster are published by the table listener once the change is stored.
+func (s *StationService) Approve(ctx context.Context, macAddress string) (*models.Station, error) {
+	return s.setProvisioningStatus(ctx, macAddress, models.ProvisioningApproved,
+		models.ProvisioningPending, models.ProvisioningRejected)
+}
+
+// Reject keeps a station out of the fleet. Updates it publishes afterwards are
+// ignored, and the retained state of an approved station is removed.
+func (s *StationService) Reject(ctx context.Context, macAddress string) (*models.Station, error) {
+	return s.setProvisioningStatus(ctx, macAddress, models.ProvisioningRejected,
+		models.ProvisioningPending, models.ProvisioningApproved)
+}
+
+// Pending returns the stations awaiting approval, oldest first.
+func (s *StationService) Pending(ctx context.Context) ([]models.Station, error) {
+	return s.stationRepository.FindByProvisioningStatus(ctx, models.ProvisioningPending)
+}
+
+func (s *StationService) setProvisioningStatus(ctx context.Context, macAddress string, status models.ProvisioningStatus, from ...models.ProvisioningStatus) (*models.Station, error) {
+	macAddress = normalizeMacAddress(macAddress)
+
+	station, err := s.stationRepository.SetProvisioningStatus(ctx, macAddress, status, from...)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStation, macAddress)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to set provisioning status: %w", err)
+	}
+
+	s.logger.Info().
+		Str("mac_address", macAddress).
+		Str("status", string(status)).
+		Msg("Changed station provisioning status")
+
+	return station, nil
+}
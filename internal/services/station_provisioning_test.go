@@ -0,0 +1,96 @@
+package services
+
+import (
+	"gps-no-sync/internal/models"
+	"testing"
+)
+
+func TestProvisioningPolicyStatusFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *ProvisioningPolicy
+		macAddress string
+		want       models.ProvisioningStatus
+	}{
+		{
+			name:       "nil policy approves",
+			macAddress: "aa:bb:cc:dd:ee:ff",
+			want:       models.ProvisioningApproved,
+		},
+		{
+			name:       "open approves",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyOpen, nil),
+			macAddress: "aa:bb:cc:dd:ee:ff",
+			want:       models.ProvisioningApproved,
+		},
+		{
+			name:       "manual keeps pending",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyManual, []string{"aa:bb:cc"}),
+			macAddress: "aa:bb:cc:dd:ee:ff",
+			want:       models.ProvisioningPending,
+		},
+		{
+			name:       "unknown mode keeps pending",
+			policy:     NewProvisioningPolicy("unknown", nil),
+			macAddress: "aa:bb:cc:dd:ee:ff",
+			want:       models.ProvisioningPending,
+		},
+		{
+			name:       "allowlist approves listed prefix",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyAllowlist, []string{"aa:bb:cc"}),
+			macAddress: "aa:bb:cc:dd:ee:ff",
+			want:       models.ProvisioningApproved,
+		},
+		{
+			name:       "allowlist approves full address",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyAllowlist, []string{"11:22:33:44:55:66"}),
+			macAddress: "11:22:33:44:55:66",
+			want:       models.ProvisioningApproved,
+		},
+		{
+			name:       "allowlist ignores case and separators",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyAllowlist, []string{" AA-BB-CC "}),
+			macAddress: "aabb.ccdd.eeff",
+			want:       models.ProvisioningApproved,
+		},
+		{
+			name:       "allowlist keeps unlisted pending",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyAllowlist, []string{"aa:bb:cc"}),
+			macAddress: "aa:bb:cd:dd:ee:ff",
+			want:       models.ProvisioningPending,
+		},
+		{
+			name:       "empty allowlist entries approve nothing",
+			policy:     NewProvisioningPolicy(ProvisioningPolicyAllowlist, []string{"", " "}),
+			macAddress: "aa:bb:cc:dd:ee:ff",
+			want:       models.ProvisioningPending,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.StatusFor(tt.macAddress); got != tt.want {
+				t.Errorf("StatusFor(%s) = %s, want %s", tt.macAddress, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeMacAddress(t *testing.T) {
+	tests := []struct {
+		macAddress string
+		want       string
+	}{
+		{macAddress: "aa:bb:cc:dd:ee:ff", want: "aa:bb:cc:dd:ee:ff"},
+		{macAddress: "AA-BB-CC-DD-EE-FF", want: "aa:bb:cc:dd:ee:ff"},
+		{macAddress: "aabb.ccdd.eeff", want: "aa:bb:cc:dd:ee:ff"},
+		{macAddress: "AABBCCDDEEFF", want: "aa:bb:cc:dd:ee:ff"},
+		{macAddress: "Not-A-MAC", want: "not-a-mac"},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeMacAddress(tt.macAddress); got != tt.want {
+			t.Errorf("normalizeMacAddress(%s) = %s, want %s", tt.macAddress, got, tt.want)
+		}
+	}
+}
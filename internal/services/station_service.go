@@ -2,14 +2,19 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog"
+	"gorm.io/gorm"
 	"gps-no-sync/internal/database/postgres/repositories"
 	"gps-no-sync/internal/models"
 	"gps-no-sync/internal/mq"
 	"strings"
+	"time"
 )
 
+var ErrInvalidPatch = errors.New("invalid station patch")
+
 type StationService struct {
 	stationRepository *repositories.StationRepository
 	clusterRepository *repositories.ClusterRepository
@@ -17,9 +22,11 @@ type StationService struct {
 	client            *mq.Client
 	topicManager      *mq.TopicManager
 	logger            zerolog.Logger
+	conflictPolicy    string
+	provisioning      *ProvisioningPolicy
 }
 
-func NewStationService(stationRepository *repositories.StationRepository, clusterService *ClusterService, clusterRepository *repositories.ClusterRepository, client *mq.Client, topicManager *mq.TopicManager, logger zerolog.Logger) *StationService {
+func NewStationService(stationRepository *repositories.StationRepository, clusterService *ClusterService, clusterRepository *repositories.ClusterRepository, client *mq.Client, topicManager *mq.TopicManager, logger zerolog.Logger, conflictPolicy string, provisioning *ProvisioningPolicy) *StationService {
 	return &StationService{
 		stationRepository: stationRepository,
 		clusterRepository: clusterRepository,
@@ -27,6 +34,8 @@ func NewStationService(stationRepository *repositories.StationRepository, cluste
 		client:            client,
 		topicManager:      topicManager,
 		logger:            logger,
+		conflictPolicy:    conflictPolicy,
+		provisioning:      provisioning,
 	}
 }
 
@@ -42,10 +51,13 @@ func (s *StationService) IsValidStation(station *models.Station) bool {
 	return true
 }
 
-func (s *StationService) ProcessMessage(ctx context.Context, stationMessage *mq.StationMessage) {
-	if stationMessage.Source == "SYNC" {
-		return
+// ProcessMessage applies a station update received from MQTT. Stale updates
+// rejected by the conflict policy return a *ConflictError.
+func (s *StationService) ProcessMessage(ctx context.Context, stationMessage *mq.StationMessage) error {
+	if s.client.IsEcho(stationMessage.Provenance) {
+		return nil
 	}
+	ctx = mq.WithProvenance(ctx, stationMessage.Provenance)
 
 	stationDto := stationMessage.Data
 
@@ -72,27 +84,75 @@ func (s *StationService) ProcessMessage(ctx context.Context, stationMessage *mq.
 		if !station.IsValid() {
 			station.LoadDefault()
 		}
+		station.Revision = stationDto.BaseRevision() + 1
+		station.ProvisioningStatus = s.provisioning.StatusFor(station.MacAddress)
 
-		station.Topic = s.topicManager.ExtractStationId(stationMessage.Topic)
+		topicID, err := s.topicManager.ExtractStationId(stationMessage.Topic)
+		if err != nil {
+			s.logger.Error().Err(err).
+				Str("mac_address", station.MacAddress).
+				Msg("Failed to extract station id from topic")
+			return err
+		}
+		station.Topic = topicID
 
-		err := s.stationRepository.Create(ctx, station)
+		err = s.stationRepository.Create(ctx, station)
 		if err != nil {
 			s.logger.Error().Err(err).
 				Str("mac_address", station.MacAddress).
 				Msg("Failed to create station in database")
-			return
+			return err
+		}
+
+		if !station.IsApproved() {
+			s.logger.Warn().
+				Str("mac_address", station.MacAddress).
+				Str("topic", station.Topic).
+				Msg("Unknown station is awaiting approval")
+			return nil
 		}
 
 		syncStation = station
 	} else {
+		if !dbStation.IsApproved() {
+			s.logger.Debug().
+				Str("mac_address", dbStation.MacAddress).
+				Str("status", string(dbStation.ProvisioningStatus)).
+				Msg("Ignoring update of station that is not approved")
+			return nil
+		}
+
+		// The retained state already matches the database. Republishing it would
+		// answer every publish of another instance with one of our own.
+		if dbStation.IsEqual(stationDto) && (stationDto.Revision == nil || *stationDto.Revision == dbStation.Revision) {
+			return nil
+		}
+
 		if !dbStation.IsEqual(stationDto) {
+			if conflict := checkRevision(s.conflictPolicy, dbStation, &stationDto); conflict != nil {
+				s.logger.Warn().
+					Str("mac_address", dbStation.MacAddress).
+					Uint64("revision", stationDto.BaseRevision()).
+					Uint64("current_revision", dbStation.Revision).
+					Str("policy", s.conflictPolicy).
+					Msg("Rejected stale station update")
+
+				// Replace the stale retained state with the current one.
+				s.publishStation(ctx, dbStation)
+				return conflict
+			}
+
+			now := time.Now()
 			dbStation.UpdateFromDto(&stationDto)
+			dbStation.Revision = max(dbStation.Revision, stationDto.BaseRevision()) + 1
+			dbStation.UpdatedAt = &now
+
 			err := s.stationRepository.Update(ctx, dbStation)
 			if err != nil {
 				s.logger.Error().Err(err).
 					Str("mac_address", dbStation.MacAddress).
 					Msg("Failed to update station in database")
-				return
+				return err
 			}
 		}
 		syncStation = dbStation
@@ -103,8 +163,10 @@ func (s *StationService) ProcessMessage(ctx context.Context, stationMessage *mq.
 		s.logger.Error().Err(err).
 			Str("mac_address", stationDto.MacAddress).
 			Msg("Failed to sync updated station to MQTTConfig")
-		return
+		return err
 	}
+
+	return nil
 }
 
 func (s *StationService) ProcessDbUpdate(ctx context.Context, station *models.Station) error {
@@ -168,11 +230,34 @@ func (s *StationService) GetByMacAddress(ctx context.Context, macAddress string)
 	return station, nil
 }
 
+// SyncToMqtt publishes the station and the clusters. Pending stations are
+// not published until they are approved.
 func (s *StationService) SyncToMqtt(ctx context.Context, station *models.Station) error {
+	if station.ProvisioningStatus == models.ProvisioningPending {
+		return nil
+	}
+
+	s.publishStation(ctx, station)
+
+	err := s.clusterService.SyncAll(ctx)
+
+	if err != nil {
+		s.logger.Error().Err(err).
+			Msg("Failed to sync clusters after syncing station to MQTTConfig")
+	}
+
+	return nil
+}
+
+func (s *StationService) publishStation(ctx context.Context, station *models.Station) {
+	if station.ProvisioningStatus == models.ProvisioningPending {
+		return
+	}
+
 	stationTopic := s.topicManager.GetStationTopic()
 	targetTopic := strings.Replace(stationTopic, "+", station.Topic, 1)
 
-	if station.DeletedAt != nil {
+	if station.DeletedAt != nil || station.ProvisioningStatus == models.ProvisioningRejected {
 		if err := s.client.Publish(targetTopic, nil); err != nil {
 			s.logger.Error().Err(err).
 				Str("topic", targetTopic).
@@ -181,23 +266,63 @@ func (s *StationService) SyncToMqtt(ctx context.Context, station *models.Station
 	} else {
 		stationDto := station.ToDto()
 
-		if err := s.client.PublishJson(targetTopic, stationDto); err != nil {
+		if err := s.client.PublishJsonContext(ctx, targetTopic, stationDto); err != nil {
 			s.logger.Error().Err(err).
 				Str("topic", targetTopic).
 				Msg("Failed to publish station data to MQTTConfig")
 		}
 	}
+}
 
-	err := s.clusterService.SyncAll(ctx)
+// Repair republishes the canonical retained state of the station behind the
+// topic id, or a tombstone when no such station exists.
+func (s *StationService) Repair(ctx context.Context, topicID string) error {
+	station, err := s.stationRepository.FindByTopic(ctx, topicID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("error finding station by topic %s: %w", topicID, err)
+	}
 
-	if err != nil {
-		s.logger.Error().Err(err).
-			Msg("Failed to sync clusters after syncing station to MQTTConfig")
+	if station == nil {
+		now := time.Now()
+		station = &models.Station{Topic: topicID, DeletedAt: &now}
 	}
 
+	s.publishStation(ctx, station)
 	return nil
 }
 
+// ApplyPatch applies an RFC 7386 merge patch to the station published on topic
+// id and republishes its canonical state. validate is called with the patched
+// station before it is saved. The MAC address identifies the station and
+// cannot be patched.
+func (s *StationService) ApplyPatch(ctx context.Context, topicID string, patch []byte, provenance mq.Provenance, validate func(data []byte) error) error {
+	if s.client.IsEcho(provenance) {
+		return nil
+	}
+	ctx = mq.WithProvenance(ctx, provenance)
+
+	clusterExists := func(clusterID uint) bool {
+		_, err := s.clusterRepository.FindById(ctx, clusterID)
+		return err == nil
+	}
+
+	station, err := s.stationRepository.UpdateByTopic(ctx, topicID, func(station *models.Station) error {
+		return patchStation(station, patch, validate, clusterExists, s.conflictPolicy)
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: %s", ErrUnknownStation, topicID)
+	} else if err != nil {
+		return err
+	}
+
+	s.logger.Info().
+		Str("topic", topicID).
+		Uint64("revision", station.Revision).
+		Msg("Applied station patch")
+
+	return s.SyncToMqtt(ctx, station)
+}
+
 func (s *StationService) SyncAll(ctx context.Context) error {
 	stations, err := s.stationRepository.FindAllWhereIsNotDeleted(ctx)
 	if err != nil {